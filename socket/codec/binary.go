@@ -0,0 +1,693 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMaxDepth = 64
+
+// Limits bound what the binary codecs accept, so untrusted messages can't
+// make them allocate without bounds. Lengths declared in a message are
+// always checked against the bytes left in it. Zero fields use the defaults.
+type Limits struct {
+	// MaxSize is the largest message in bytes. Zero means no limit beyond
+	// the read limit of the connection.
+	MaxSize int
+	// MaxLength is the largest number of elements of an array or map and
+	// of bytes of a string. Zero means no limit beyond the message size.
+	MaxLength int
+	// MaxDepth is the deepest nesting of arrays, maps and pointers,
+	// 64 by default.
+	MaxDepth int
+}
+
+func (l Limits) maxDepth() int {
+	if l.MaxDepth <= 0 {
+		return defaultMaxDepth
+	}
+	return l.MaxDepth
+}
+
+var errUnexpectedEnd = errors.New("codec: Unexpected end of message")
+
+type itemKind uint8
+
+const (
+	kindNil itemKind = iota
+	kindBool
+	kindInt
+	kindUint
+	kindFloat
+	kindString
+	kindBytes
+	kindArray
+	kindMap
+	kindTime
+	// kindExt is a MessagePack extension other than a timestamp.
+	kindExt
+	// kindBreak ends an array, map or string of indefinite length.
+	kindBreak
+)
+
+var kindNames = [...]string{"nil", "bool", "integer", "integer", "float", "string", "bytes", "array", "map", "time", "extension", "break"}
+
+func (k itemKind) String() string {
+	return kindNames[k]
+}
+
+// item is a value read from a message. Strings and bytes point into the
+// message, arrays and maps only carry their length; their elements follow.
+type item struct {
+	kind itemKind
+	b    bool
+	// i holds negative integers, u the others.
+	i int64
+	u uint64
+	f float64
+	s []byte
+	// n is the length of an array or map, -1 if it ends with a break.
+	n int
+	t time.Time
+}
+
+// format is the wire format of a binary codec.
+type format interface {
+	appendNil(b []byte) []byte
+	appendBool(b []byte, v bool) []byte
+	appendInt(b []byte, v int64) []byte
+	appendUint(b []byte, v uint64) []byte
+	appendFloat32(b []byte, v float32) []byte
+	appendFloat64(b []byte, v float64) []byte
+	appendString(b []byte, s string) []byte
+	appendBytes(b []byte, p []byte) []byte
+	appendArrayHeader(b []byte, n int) []byte
+	appendMapHeader(b []byte, n int) []byte
+	appendTime(b []byte, t time.Time) []byte
+	// readItem reads the next item of d.
+	readItem(d *decoder) (item, error)
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+type encoder struct {
+	f      format
+	tag    string
+	b      []byte
+	depth  int
+	limits Limits
+}
+
+func marshal(f format, tag string, limits Limits, v any) ([]byte, error) {
+	e := &encoder{f: f, tag: tag, limits: limits}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.b, nil
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.b = e.f.appendNil(e.b)
+		return nil
+	}
+	if v.Type() == timeType {
+		e.b = e.f.appendTime(e.b, v.Interface().(time.Time))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		e.b = e.f.appendBool(e.b, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.b = e.f.appendInt(e.b, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.b = e.f.appendUint(e.b, v.Uint())
+	case reflect.Float32:
+		e.b = e.f.appendFloat32(e.b, float32(v.Float()))
+	case reflect.Float64:
+		e.b = e.f.appendFloat64(e.b, v.Float())
+	case reflect.String:
+		e.b = e.f.appendString(e.b, v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.b = e.f.appendNil(e.b)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.b = e.f.appendBytes(e.b, v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			p := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(p), v)
+			e.b = e.f.appendBytes(e.b, p)
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.b = e.f.appendNil(e.b)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.b = e.f.appendNil(e.b)
+			return nil
+		}
+		return e.nested(func() error { return e.encode(v.Elem()) })
+	default:
+		return fmt.Errorf("codec: Unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// nested runs fn one level deeper, which also ends cycles of pointers.
+func (e *encoder) nested(fn func() error) error {
+	if e.depth >= e.limits.maxDepth() {
+		return fmt.Errorf("codec: Value is nested deeper than %d levels", e.limits.maxDepth())
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+	return fn()
+}
+
+func (e *encoder) encodeArray(v reflect.Value) error {
+	e.b = e.f.appendArrayHeader(e.b, v.Len())
+	return e.nested(func() error {
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *encoder) encodeMap(v reflect.Value) error {
+	e.b = e.f.appendMapHeader(e.b, v.Len())
+	return e.nested(func() error {
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *encoder) encodeStruct(v reflect.Value) error {
+	fields := cachedFields(v.Type(), e.tag)
+	n := 0
+	for _, f := range fields {
+		if !f.omitEmpty || !isEmpty(v.FieldByIndex(f.index)) {
+			n++
+		}
+	}
+
+	e.b = e.f.appendMapHeader(e.b, n)
+	return e.nested(func() error {
+		for _, f := range fields {
+			fv := v.FieldByIndex(f.index)
+			if f.omitEmpty && isEmpty(fv) {
+				continue
+			}
+			e.b = e.f.appendString(e.b, f.name)
+			if err := e.encode(fv); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// isEmpty reports whether omitempty leaves v out, as encoding/json does.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type fieldsKey struct {
+	t   reflect.Type
+	tag string
+}
+
+var fieldCache sync.Map
+
+// cachedFields returns the fields of a struct type as named by the tag.
+// Fields of embedded structs without a name in the tag are promoted, unless
+// a field of the outer struct has the same name.
+func cachedFields(t reflect.Type, tag string) []field {
+	key := fieldsKey{t, tag}
+	if fields, ok := fieldCache.Load(key); ok {
+		return fields.([]field)
+	}
+
+	var fields, promoted []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, opts, _ := strings.Cut(sf.Tag.Get(tag), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range cachedFields(sf.Type, tag) {
+				f.index = append([]int{i}, f.index...)
+				promoted = append(promoted, f)
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{name: name, index: []int{i}, omitEmpty: opts == "omitempty"})
+	}
+	for _, f := range promoted {
+		if !slices.ContainsFunc(fields, func(g field) bool { return g.name == f.name }) {
+			fields = append(fields, f)
+		}
+	}
+
+	fieldCache.Store(key, fields)
+	return fields
+}
+
+type decoder struct {
+	f      format
+	tag    string
+	data   []byte
+	pos    int
+	depth  int
+	limits Limits
+}
+
+func unmarshal(f format, tag string, limits Limits, data []byte, v any) error {
+	if limits.MaxSize > 0 && len(data) > limits.MaxSize {
+		return fmt.Errorf("codec: Message of %d bytes exceeds the limit of %d", len(data), limits.MaxSize)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("codec: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+
+	d := &decoder{f: f, tag: tag, data: data, limits: limits}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("codec: Unexpected data after the value")
+	}
+	return nil
+}
+
+// read consumes the next n bytes.
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errUnexpectedEnd
+	}
+	p := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return p, nil
+}
+
+// readUint consumes a big-endian unsigned integer of size bytes.
+func (d *decoder) readUint(size int) (uint64, error) {
+	p, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, b := range p {
+		n = n<<8 | uint64(b)
+	}
+	return n, nil
+}
+
+// checkLength rejects a declared length the rest of the message can't hold,
+// with every element taking at least minSize bytes.
+func (d *decoder) checkLength(n uint64, minSize int) (int, error) {
+	if d.limits.MaxLength > 0 && n > uint64(d.limits.MaxLength) {
+		return 0, fmt.Errorf("codec: Length %d exceeds the limit of %d", n, d.limits.MaxLength)
+	}
+	if n > uint64((len(d.data)-d.pos)/minSize) {
+		return 0, errUnexpectedEnd
+	}
+	return int(n), nil
+}
+
+func (d *decoder) nested(fn func() error) error {
+	if d.depth >= d.limits.maxDepth() {
+		return fmt.Errorf("codec: Value is nested deeper than %d levels", d.limits.maxDepth())
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	return fn()
+}
+
+// elements calls fn for every element of the array or map it started.
+// Only CBOR has lengths ending with a break, which is the byte 0xff.
+func (d *decoder) elements(it item, fn func() error) error {
+	return d.nested(func() error {
+		if it.n >= 0 {
+			for i := 0; i < it.n; i++ {
+				if err := fn(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		for {
+			if d.pos >= len(d.data) {
+				return errUnexpectedEnd
+			}
+			if d.data[d.pos] == 0xff {
+				d.pos++
+				return nil
+			}
+			if err := fn(); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func (d *decoder) next() (item, error) {
+	it, err := d.f.readItem(d)
+	if err == nil && it.kind == kindBreak {
+		return item{}, fmt.Errorf("codec: Unexpected break")
+	}
+	return it, err
+}
+
+func (d *decoder) decode(v reflect.Value) error {
+	it, err := d.next()
+	if err != nil {
+		return err
+	}
+	return d.decodeItem(it, v)
+}
+
+func (d *decoder) decodeItem(it item, v reflect.Value) error {
+	if it.kind == kindNil {
+		v.SetZero()
+		return nil
+	}
+
+	switch {
+	case v.Kind() == reflect.Pointer:
+		return d.nested(func() error {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			return d.decodeItem(it, v.Elem())
+		})
+	case v.Kind() == reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("codec: Cannot decode into %s", v.Type())
+		}
+		x, err := d.generic(it)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.SetZero()
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+		return nil
+	case v.Type() == timeType:
+		if it.kind != kindTime {
+			return mismatch(it, v)
+		}
+		v.Set(reflect.ValueOf(it.t))
+		return nil
+	}
+
+	switch it.kind {
+	case kindBool:
+		if v.Kind() != reflect.Bool {
+			return mismatch(it, v)
+		}
+		v.SetBool(it.b)
+	case kindInt, kindUint, kindFloat:
+		return setNumber(it, v)
+	case kindString, kindBytes:
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(it.s))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append(make([]byte, 0, len(it.s)), it.s...))
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetZero()
+			reflect.Copy(v, reflect.ValueOf(it.s))
+		default:
+			return mismatch(it, v)
+		}
+	case kindArray:
+		return d.decodeArray(it, v)
+	case kindMap:
+		switch v.Kind() {
+		case reflect.Map:
+			return d.decodeMap(it, v)
+		case reflect.Struct:
+			return d.decodeStruct(it, v)
+		}
+		return mismatch(it, v)
+	default:
+		return mismatch(it, v)
+	}
+	return nil
+}
+
+func mismatch(it item, v reflect.Value) error {
+	return fmt.Errorf("codec: Cannot decode %s into %s", it.kind, v.Type())
+}
+
+func setNumber(it item, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := it.i
+		switch {
+		case it.kind == kindUint && it.u > math.MaxInt64:
+			return fmt.Errorf("codec: Integer %d overflows %s", it.u, v.Type())
+		case it.kind == kindUint:
+			n = int64(it.u)
+		case it.kind == kindFloat:
+			return mismatch(it, v)
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("codec: Integer %d overflows %s", n, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if it.kind != kindUint {
+			return mismatch(it, v)
+		}
+		if v.OverflowUint(it.u) {
+			return fmt.Errorf("codec: Integer %d overflows %s", it.u, v.Type())
+		}
+		v.SetUint(it.u)
+	case reflect.Float32, reflect.Float64:
+		switch it.kind {
+		case kindInt:
+			v.SetFloat(float64(it.i))
+		case kindUint:
+			v.SetFloat(float64(it.u))
+		default:
+			v.SetFloat(it.f)
+		}
+	default:
+		return mismatch(it, v)
+	}
+	return nil
+}
+
+func (d *decoder) decodeArray(it item, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		// The slice grows with the elements actually read rather than
+		// with the declared length.
+		s := reflect.MakeSlice(v.Type(), 0, min(max(it.n, 0), 64))
+		err := d.elements(it, func() error {
+			s = reflect.Append(s, reflect.Zero(v.Type().Elem()))
+			return d.decode(s.Index(s.Len() - 1))
+		})
+		if err != nil {
+			return err
+		}
+		v.Set(s)
+		return nil
+	case reflect.Array:
+		v.SetZero()
+		i := 0
+		return d.elements(it, func() error {
+			defer func() { i++ }()
+			if i >= v.Len() {
+				return d.skip()
+			}
+			return d.decode(v.Index(i))
+		})
+	}
+	return mismatch(it, v)
+}
+
+func (d *decoder) decodeMap(it item, v reflect.Value) error {
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, min(max(it.n, 0), 64)))
+	}
+	return d.elements(it, func() error {
+		key := reflect.New(t.Key()).Elem()
+		if err := d.decode(key); err != nil {
+			return err
+		}
+		value := reflect.New(t.Elem()).Elem()
+		if err := d.decode(value); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, value)
+		return nil
+	})
+}
+
+func (d *decoder) decodeStruct(it item, v reflect.Value) error {
+	fields := cachedFields(v.Type(), d.tag)
+	return d.elements(it, func() error {
+		key, err := d.next()
+		if err != nil {
+			return err
+		}
+		if key.kind != kindString {
+			return fmt.Errorf("codec: Cannot decode %s key into a field of %s", key.kind, v.Type())
+		}
+
+		i := slices.IndexFunc(fields, func(f field) bool { return f.name == string(key.s) })
+		if i < 0 {
+			return d.skip()
+		}
+		return d.decode(v.FieldByIndex(fields[i].index))
+	})
+}
+
+// skip reads over the next value.
+func (d *decoder) skip() error {
+	it, err := d.next()
+	if err != nil {
+		return err
+	}
+	switch it.kind {
+	case kindArray:
+		return d.elements(it, d.skip)
+	case kindMap:
+		return d.elements(it, func() error {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			return d.skip()
+		})
+	}
+	return nil
+}
+
+// generic decodes an item into the types encoding/json would use for an
+// interface value, with integers as int64 or uint64, bytes as []byte and
+// maps with other than string keys as map[any]any.
+func (d *decoder) generic(it item) (any, error) {
+	switch it.kind {
+	case kindNil:
+		return nil, nil
+	case kindBool:
+		return it.b, nil
+	case kindInt:
+		return it.i, nil
+	case kindUint:
+		if it.u <= math.MaxInt64 {
+			return int64(it.u), nil
+		}
+		return it.u, nil
+	case kindFloat:
+		return it.f, nil
+	case kindString:
+		return string(it.s), nil
+	case kindBytes:
+		return append(make([]byte, 0, len(it.s)), it.s...), nil
+	case kindTime:
+		return it.t, nil
+	case kindArray:
+		s := make([]any, 0, min(max(it.n, 0), 64))
+		err := d.elements(it, func() error {
+			x, err := d.nextGeneric()
+			s = append(s, x)
+			return err
+		})
+		return s, err
+	case kindMap:
+		m := make(map[any]any, min(max(it.n, 0), 64))
+		stringKeys := true
+		err := d.elements(it, func() error {
+			key, err := d.nextGeneric()
+			if err != nil {
+				return err
+			}
+			if key != nil && !reflect.TypeOf(key).Comparable() {
+				return fmt.Errorf("codec: Unsupported map key of type %T", key)
+			}
+			_, isString := key.(string)
+			stringKeys = stringKeys && isString
+			value, err := d.nextGeneric()
+			m[key] = value
+			return err
+		})
+		if err != nil || !stringKeys {
+			return m, err
+		}
+		sm := make(map[string]any, len(m))
+		for k, v := range m {
+			sm[k.(string)] = v
+		}
+		return sm, nil
+	}
+	return nil, fmt.Errorf("codec: Unexpected %s", it.kind)
+}
+
+func (d *decoder) nextGeneric() (any, error) {
+	it, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+	return d.generic(it)
+}
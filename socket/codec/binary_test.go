@@ -0,0 +1,232 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Base struct {
+	ID      int64
+	Created time.Time
+}
+
+type record struct {
+	Base
+	Name     string            `msgpack:"name" cbor:"name"`
+	Tags     []string          `msgpack:"tags,omitempty" cbor:"tags,omitempty"`
+	Scores   map[string]uint16 `msgpack:"scores" cbor:"scores"`
+	Ratio    float32
+	Weight   float64
+	Raw      []byte
+	Key      [4]byte
+	Parent   *record `msgpack:",omitempty" cbor:",omitempty"`
+	Any      any
+	Skipped  string `msgpack:"-" cbor:"-"`
+	internal int
+}
+
+var binaryCodecs = map[string]Codec{"msgpack": MsgPack, "cbor": CBOR}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	want := record{
+		Base:   Base{ID: -42, Created: time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)},
+		Name:   "κόσμε",
+		Tags:   []string{"a", "b"},
+		Scores: map[string]uint16{"x": 1, "y": 65535},
+		Ratio:  0.5,
+		Weight: math.Pi,
+		Raw:    []byte{0, 1, 2},
+		Key:    [4]byte{1, 2, 3, 4},
+		Parent: &record{Name: "parent", Base: Base{Created: time.Unix(1e9, 0).UTC()}},
+		Any:    []any{int64(1), "two", map[string]any{"three": 3.0}},
+	}
+
+	for name, c := range binaryCodecs {
+		t.Run(name, func(t *testing.T) {
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			got := record{Skipped: "kept", internal: 7}
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if got.Skipped != "kept" || got.internal != 7 {
+				t.Error("unmarshal touched skipped fields")
+			}
+			got.Skipped, got.internal = "", 0
+			if !got.Created.Equal(want.Created) || !got.Parent.Created.Equal(want.Parent.Created) {
+				t.Errorf("times changed: %v, %v", got.Created, got.Parent.Created)
+			}
+			got.Created, got.Parent.Created = want.Created, want.Parent.Created
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+
+			// Tags rename fields, embedded fields are promoted and empty
+			// fields are left out.
+			var m map[string]any
+			if err := c.Unmarshal(data, &m); err != nil {
+				t.Fatalf("unmarshal into a map: %v", err)
+			}
+			for _, key := range []string{"name", "tags", "ID", "Created"} {
+				if _, ok := m[key]; !ok {
+					t.Errorf("key %q is missing from %v", key, m)
+				}
+			}
+			for _, key := range []string{"Name", "Skipped", "internal", "Base"} {
+				if _, ok := m[key]; ok {
+					t.Errorf("unexpected key %q", key)
+				}
+			}
+			if _, ok := m["Parent"].(map[string]any)["tags"]; ok {
+				t.Error("empty field with omitempty was encoded")
+			}
+		})
+	}
+}
+
+func TestBinaryMismatch(t *testing.T) {
+	for name, c := range binaryCodecs {
+		t.Run(name, func(t *testing.T) {
+			data, _ := c.Marshal(map[string]any{"ID": 300, "Name": "x"})
+			var small struct{ ID int8 }
+			if err := c.Unmarshal(data, &small); err == nil {
+				t.Error("integer overflowing its field was accepted")
+			}
+
+			data, _ = c.Marshal(-1)
+			var u uint
+			if err := c.Unmarshal(data, &u); err == nil {
+				t.Error("negative integer was decoded into uint")
+			}
+
+			data, _ = c.Marshal("text")
+			var n int
+			if err := c.Unmarshal(data, &n); err == nil {
+				t.Error("string was decoded into int")
+			}
+			if err := c.Unmarshal(data, n); err == nil {
+				t.Error("unmarshal into a non-pointer succeeded")
+			}
+
+			// Unknown fields are skipped.
+			data, _ = c.Marshal(map[string]any{"Other": []any{map[string]any{"deep": 1}}, "ID": 5})
+			var known struct{ ID int }
+			if err := c.Unmarshal(data, &known); err != nil || known.ID != 5 {
+				t.Errorf("got %+v and %v, want unknown fields skipped", known, err)
+			}
+
+			if _, err := c.Marshal(make(chan int)); err == nil {
+				t.Error("channel was encoded")
+			}
+		})
+	}
+}
+
+type cycle struct {
+	Next *cycle
+}
+
+func TestBinaryLimits(t *testing.T) {
+	for name, f := range map[string]format{"msgpack": msgpackFormat{}, "cbor": cborFormat{}} {
+		t.Run(name, func(t *testing.T) {
+			// An array claiming more elements than the message holds
+			// fails before anything is allocated for them.
+			data := f.appendArrayHeader(nil, math.MaxUint32)
+			var v []any
+			if err := unmarshal(f, "", Limits{}, data, &v); !errors.Is(err, errUnexpectedEnd) {
+				t.Errorf("huge array: got %v, want %v", err, errUnexpectedEnd)
+			}
+			data = f.appendMapHeader(nil, 1000)
+			data = append(data, bytes.Repeat(f.appendNil(nil), 1500)...)
+			var m map[string]any
+			if err := unmarshal(f, "", Limits{}, data, &m); !errors.Is(err, errUnexpectedEnd) {
+				t.Errorf("huge map: got %v, want %v", err, errUnexpectedEnd)
+			}
+
+			data = f.appendString(nil, strings.Repeat("x", 100))
+			var s string
+			if err := unmarshal(f, "", Limits{MaxLength: 99}, data, &s); err == nil {
+				t.Error("string above MaxLength was accepted")
+			}
+			if err := unmarshal(f, "", Limits{MaxSize: 50}, data, &s); err == nil {
+				t.Error("message above MaxSize was accepted")
+			}
+			if err := unmarshal(f, "", Limits{MaxLength: 100, MaxSize: 200}, data, &s); err != nil {
+				t.Errorf("message within the limits: %v", err)
+			}
+
+			data = nil
+			for i := 0; i < 100; i++ {
+				data = f.appendArrayHeader(data, 1)
+			}
+			data = f.appendNil(data)
+			if err := unmarshal(f, "", Limits{}, data, &v); err == nil {
+				t.Error("array nested 100 levels deep was accepted")
+			}
+			if err := unmarshal(f, "", Limits{MaxDepth: 200}, data, &v); err != nil {
+				t.Errorf("nesting within MaxDepth: %v", err)
+			}
+
+			c := &cycle{}
+			c.Next = c
+			if _, err := marshal(f, "", Limits{}, c); err == nil {
+				t.Error("cycle was encoded")
+			}
+		})
+	}
+}
+
+func BenchmarkBinaryCodecs(b *testing.B) {
+	v := record{Name: "bench", Tags: []string{"a", "b", "c"}, Scores: map[string]uint16{"x": 1}, Raw: make([]byte, 64)}
+	for name, c := range map[string]Codec{"json": JSON, "msgpack": MsgPack, "cbor": CBOR} {
+		data, _ := c.Marshal(v)
+		b.Run(name+"/Marshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.Marshal(v)
+			}
+		})
+		b.Run(name+"/Unmarshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var r record
+				c.Unmarshal(data, &r)
+			}
+		})
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, ex := range cborExamples {
+		data, _ := hex.DecodeString(ex.hex)
+		f.Add(data, true)
+	}
+	for _, ex := range msgpackExamples {
+		data, _ := hex.DecodeString(ex.hex)
+		f.Add(data, false)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, cbor bool) {
+		c := MsgPack
+		if cbor {
+			c = CBOR
+		}
+		var v any
+		if err := c.Unmarshal(data, &v); err == nil {
+			// Whatever decodes encodes again.
+			if _, err := c.Marshal(v); err != nil {
+				t.Fatalf("marshal of decoded %#v: %v", v, err)
+			}
+		}
+		var r record
+		c.Unmarshal(data, &r)
+	})
+}
@@ -0,0 +1,297 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// CBOR encodes values as CBOR (RFC 8949) in binary messages, with the
+// default limits.
+var CBOR Codec = &CBORCodec{}
+
+// CBORCodec encodes values as CBOR. Structs become maps keyed by field name,
+// which the "cbor" struct tag changes as the "json" tag does for
+// encoding/json. Times are sent as epoch seconds (tag 1) when they are whole
+// seconds and as RFC 3339 strings (tag 0) otherwise. Decoding accepts
+// lengths of indefinite size; tags other than 0 and 1 are ignored.
+type CBORCodec struct {
+	Limits Limits
+}
+
+func (c *CBORCodec) Marshal(v any) ([]byte, error) {
+	return marshal(cborFormat{}, "cbor", c.Limits, v)
+}
+
+func (c *CBORCodec) Unmarshal(data []byte, v any) error {
+	return unmarshal(cborFormat{}, "cbor", c.Limits, data, v)
+}
+
+func (c *CBORCodec) Binary() bool {
+	return true
+}
+
+// Major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+const (
+	cborTagDateTime = 0
+	cborTagEpoch    = 1
+	// cborIndefinite is the additional information of lengths of
+	// indefinite size.
+	cborIndefinite = 31
+)
+
+type cborFormat struct{}
+
+// appendHead appends the initial byte of major type and its argument n in
+// the shortest form.
+func appendHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major|27), n)
+}
+
+func (cborFormat) appendNil(b []byte) []byte {
+	return append(b, 0xf6)
+}
+
+func (cborFormat) appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xf5)
+	}
+	return append(b, 0xf4)
+}
+
+func (cborFormat) appendInt(b []byte, v int64) []byte {
+	if v < 0 {
+		return appendHead(b, cborNegInt, uint64(^v))
+	}
+	return appendHead(b, cborUint, uint64(v))
+}
+
+func (cborFormat) appendUint(b []byte, v uint64) []byte {
+	return appendHead(b, cborUint, v)
+}
+
+func (cborFormat) appendFloat32(b []byte, v float32) []byte {
+	return binary.BigEndian.AppendUint32(append(b, 0xfa), math.Float32bits(v))
+}
+
+func (cborFormat) appendFloat64(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xfb), math.Float64bits(v))
+}
+
+func (cborFormat) appendString(b []byte, s string) []byte {
+	return append(appendHead(b, cborText, uint64(len(s))), s...)
+}
+
+func (cborFormat) appendBytes(b []byte, p []byte) []byte {
+	return append(appendHead(b, cborBytes, uint64(len(p))), p...)
+}
+
+func (cborFormat) appendArrayHeader(b []byte, n int) []byte {
+	return appendHead(b, cborArray, uint64(n))
+}
+
+func (cborFormat) appendMapHeader(b []byte, n int) []byte {
+	return appendHead(b, cborMap, uint64(n))
+}
+
+func (f cborFormat) appendTime(b []byte, t time.Time) []byte {
+	if t.Nanosecond() == 0 {
+		return f.appendInt(appendHead(b, cborTag, cborTagEpoch), t.Unix())
+	}
+	return f.appendString(appendHead(b, cborTag, cborTagDateTime), t.Format(time.RFC3339Nano))
+}
+
+// readHead reads the initial byte of a data item and its argument. The
+// argument of lengths of indefinite size is -1.
+func readHead(d *decoder) (major byte, info byte, n uint64, err error) {
+	p, err := d.read(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = p[0]>>5, p[0]&0x1f
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		n, err = d.readUint(1 << (info - 24))
+		return major, info, n, err
+	case info == cborIndefinite:
+		return major, info, 0, nil
+	}
+	return 0, 0, 0, fmt.Errorf("codec: Invalid CBOR additional information %d", info)
+}
+
+func (f cborFormat) readItem(d *decoder) (item, error) {
+	major, info, n, err := readHead(d)
+	if err != nil {
+		return item{}, err
+	}
+	if info == cborIndefinite && (major < cborBytes || major == cborTag) {
+		return item{}, fmt.Errorf("codec: Invalid indefinite length for CBOR major type %d", major)
+	}
+
+	switch major {
+	case cborUint:
+		return item{kind: kindUint, u: n}, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return item{}, fmt.Errorf("codec: CBOR integer -1-%d is out of range", n)
+		}
+		return item{kind: kindInt, i: -1 - int64(n)}, nil
+	case cborBytes, cborText:
+		kind := kindBytes
+		if major == cborText {
+			kind = kindString
+		}
+		var it item
+		if info == cborIndefinite {
+			it, err = readChunks(d, major, kind)
+		} else {
+			it, err = readString(d, kind, n)
+		}
+		if err == nil && kind == kindString && !utf8.Valid(it.s) {
+			return item{}, fmt.Errorf("codec: CBOR text is not valid UTF-8")
+		}
+		return it, err
+	case cborArray, cborMap:
+		kind := kindArray
+		if major == cborMap {
+			kind = kindMap
+		}
+		if info == cborIndefinite {
+			return item{kind: kind, n: -1}, nil
+		}
+		return readContainer(d, kind, n)
+	case cborTag:
+		return f.readTag(d, n)
+	}
+	return readSimple(d, info, n)
+}
+
+// readChunks reads a string of indefinite length, made of definite length
+// chunks of the same major type up to a break.
+func readChunks(d *decoder, major byte, kind itemKind) (item, error) {
+	var s []byte
+	for {
+		if d.pos < len(d.data) && d.data[d.pos] == 0xff {
+			d.pos++
+			return item{kind: kind, s: s}, nil
+		}
+
+		chunkMajor, info, n, err := readHead(d)
+		if err != nil {
+			return item{}, err
+		}
+		if chunkMajor != major || info == cborIndefinite {
+			return item{}, fmt.Errorf("codec: Invalid chunk in CBOR string of indefinite length")
+		}
+		chunk, err := readString(d, kind, n)
+		if err != nil {
+			return item{}, err
+		}
+		if kind == kindString && !utf8.Valid(chunk.s) {
+			return item{}, fmt.Errorf("codec: CBOR text is not valid UTF-8")
+		}
+		if d.limits.MaxLength > 0 && len(s)+len(chunk.s) > d.limits.MaxLength {
+			return item{}, fmt.Errorf("codec: Length %d exceeds the limit of %d", len(s)+len(chunk.s), d.limits.MaxLength)
+		}
+		s = append(s, chunk.s...)
+	}
+}
+
+// readTag reads the content of a tag. Times are decoded, the content of
+// other tags is read as if it had no tag.
+func (f cborFormat) readTag(d *decoder, tag uint64) (item, error) {
+	var it item
+	err := d.nested(func() error {
+		var err error
+		it, err = d.next()
+		return err
+	})
+	if err != nil || (tag != cborTagDateTime && tag != cborTagEpoch) {
+		return it, err
+	}
+
+	switch {
+	case tag == cborTagDateTime && it.kind == kindString:
+		t, err := time.Parse(time.RFC3339Nano, string(it.s))
+		if err != nil {
+			return item{}, fmt.Errorf("codec: Invalid CBOR date/time: %w", err)
+		}
+		return item{kind: kindTime, t: t}, nil
+	case tag == cborTagEpoch && it.kind == kindUint && it.u <= math.MaxInt64:
+		return item{kind: kindTime, t: time.Unix(int64(it.u), 0).UTC()}, nil
+	case tag == cborTagEpoch && it.kind == kindInt:
+		return item{kind: kindTime, t: time.Unix(it.i, 0).UTC()}, nil
+	case tag == cborTagEpoch && it.kind == kindFloat && !math.IsNaN(it.f) && !math.IsInf(it.f, 0):
+		sec, frac := math.Modf(it.f)
+		return item{kind: kindTime, t: time.Unix(int64(sec), int64(frac*1e9)).UTC()}, nil
+	}
+	return item{}, fmt.Errorf("codec: Invalid content of CBOR tag %d", tag)
+}
+
+// readSimple reads a simple value or float of major type 7.
+func readSimple(d *decoder, info byte, n uint64) (item, error) {
+	switch info {
+	case 20, 21:
+		return item{kind: kindBool, b: info == 21}, nil
+	case 22, 23:
+		// null and undefined
+		return item{kind: kindNil}, nil
+	case 25:
+		return item{kind: kindFloat, f: float16(uint16(n))}, nil
+	case 26:
+		return item{kind: kindFloat, f: float64(math.Float32frombits(uint32(n)))}, nil
+	case 27:
+		return item{kind: kindFloat, f: math.Float64frombits(n)}, nil
+	case cborIndefinite:
+		return item{kind: kindBreak}, nil
+	}
+	return item{}, fmt.Errorf("codec: Unsupported CBOR simple value %d", n)
+}
+
+// float16 converts an IEEE 754 half-precision float.
+func float16(h uint16) float64 {
+	sign, exp, mant := h>>15, int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		f = math.Inf(1)
+		if mant != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if sign != 0 {
+		f = -f
+	}
+	return f
+}
@@ -0,0 +1,125 @@
+package codec
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Examples from RFC 8949 appendix A.
+var cborExamples = []struct {
+	hex   string
+	value any
+	// decodeOnly marks encodings the encoder doesn't produce.
+	decodeOnly bool
+}{
+	{"00", int64(0), false},
+	{"17", int64(23), false},
+	{"1818", int64(24), false},
+	{"1864", int64(100), false},
+	{"1903e8", int64(1000), false},
+	{"1a000f4240", int64(1000000), false},
+	{"1b000000e8d4a51000", int64(1000000000000), false},
+	{"1bffffffffffffffff", uint64(18446744073709551615), false},
+	{"20", int64(-1), false},
+	{"29", int64(-10), false},
+	{"3863", int64(-100), false},
+	{"3903e7", int64(-1000), false},
+	{"fb3ff199999999999a", 1.1, false},
+	{"f93e00", 1.5, true},
+	{"f97bff", 65504.0, true},
+	{"fa47c35000", 100000.0, true},
+	{"f90001", 5.960464477539063e-8, true},
+	{"f9c400", -4.0, true},
+	{"f97c00", math.Inf(1), true},
+	{"f4", false, false},
+	{"f5", true, false},
+	{"f6", nil, false},
+	{"f7", nil, true},
+	{"40", []byte{}, false},
+	{"4401020304", []byte{1, 2, 3, 4}, false},
+	{"60", "", false},
+	{"6161", "a", false},
+	{"6449455446", "IETF", false},
+	{"62c3bc", "ü", false},
+	{"80", []any{}, false},
+	{"83010203", []any{int64(1), int64(2), int64(3)}, false},
+	{"8301820203820405", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}, false},
+	{"a0", map[string]any{}, false},
+	{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}, true},
+	{"a26161016162820203", map[string]any{"a": int64(1), "b": []any{int64(2), int64(3)}}, true},
+	{"c074323031332d30332d32315432303a30343a30305a", time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC), true},
+	{"c11a514b67b0", time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC), false},
+	{"c1fb41d452d9ec200000", time.Date(2013, 3, 21, 20, 4, 0, 5e8, time.UTC), true},
+	{"d74401020304", []byte{1, 2, 3, 4}, true},
+	{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}, true},
+	{"7f657374726561646d696e67ff", "streaming", true},
+	{"9fff", []any{}, true},
+	{"9f018202039f0405ffff", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}, true},
+	{"83018202039f0405ff", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}, true},
+	{"bf61610161629f0203ffff", map[string]any{"a": int64(1), "b": []any{int64(2), int64(3)}}, true},
+}
+
+func TestCBORExamples(t *testing.T) {
+	for _, ex := range cborExamples {
+		data, _ := hex.DecodeString(ex.hex)
+		var got any
+		if err := CBOR.Unmarshal(data, &got); err != nil {
+			t.Errorf("decode %s: %v", ex.hex, err)
+			continue
+		}
+		if !equalValues(got, ex.value) {
+			t.Errorf("decode %s: got %#v, want %#v", ex.hex, got, ex.value)
+		}
+
+		if ex.decodeOnly {
+			continue
+		}
+		encoded, err := CBOR.Marshal(ex.value)
+		if err != nil || hex.EncodeToString(encoded) != ex.hex {
+			t.Errorf("encode %#v: got %x and %v, want %s", ex.value, encoded, err, ex.hex)
+		}
+	}
+}
+
+// equalValues is reflect.DeepEqual that compares times with Equal.
+func equalValues(a, b any) bool {
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	if fa, ok := a.(float64); ok && math.IsNaN(fa) {
+		fb, ok := b.(float64)
+		return ok && math.IsNaN(fb)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestCBORInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"18",           // missing argument
+		"1c",           // reserved additional information
+		"1f",           // indefinite integer
+		"62c3",         // text shorter than its length
+		"61ff",         // invalid UTF-8
+		"5f6161ff",     // text chunk in a byte string
+		"5f5f4100ffff", // nested indefinite chunk
+		"9f01",         // missing break
+		"ff",           // stray break
+		"f818",         // simple value
+		"3bffffffffffffffff",
+		"c06161", // date/time that doesn't parse
+		"c16161", // epoch that isn't a number
+		"9bffffffffffffffff",
+		"0000", // trailing data
+	} {
+		data, _ := hex.DecodeString(input)
+		var v any
+		if err := CBOR.Unmarshal(data, &v); err == nil {
+			t.Errorf("decode %s: got %#v, want an error", input, v)
+		}
+	}
+}
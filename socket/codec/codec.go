@@ -0,0 +1,81 @@
+// Package codec encodes values as WebSocket messages.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec turns values into messages and back.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	// Binary reports whether the messages are sent as binary messages.
+	// Text codecs produce valid UTF-8.
+	Binary() bool
+}
+
+var (
+	// JSON encodes values with encoding/json into text messages.
+	JSON Codec = jsonCodec{}
+	// Gob encodes values with encoding/gob into binary messages. Every
+	// message carries its own type information.
+	Gob Codec = gobCodec{}
+)
+
+// maxQuoted is how much of a message DecodeError quotes.
+const maxQuoted = 64
+
+// DecodeError is returned when a received message can't be decoded.
+type DecodeError struct {
+	// Message is the message that failed to decode.
+	Message []byte
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	quoted := e.Message
+	suffix := ""
+	if len(quoted) > maxQuoted {
+		quoted, suffix = quoted[:maxQuoted], "..."
+	}
+	return fmt.Sprintf("codec: Failed to decode message %q%s (%d bytes): %v", quoted, suffix, len(e.Message), e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) Binary() bool {
+	return true
+}
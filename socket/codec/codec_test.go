@@ -0,0 +1,44 @@
+package codec
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+type point struct {
+	X, Y int
+	Name string
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, c := range map[string]Codec{"json": JSON, "gob": Gob, "msgpack": MsgPack, "cbor": CBOR} {
+		t.Run(name, func(t *testing.T) {
+			want := point{X: 1, Y: -2, Name: "κόσμε"}
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if !c.Binary() && !utf8.Valid(data) {
+				t.Errorf("text codec produced invalid UTF-8: %q", data)
+			}
+
+			var got point
+			if err := c.Unmarshal(data, &got); err != nil || got != want {
+				t.Errorf("got %+v and %v, want %+v", got, err, want)
+			}
+		})
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	cause := errors.New("bad input")
+	err := error(&DecodeError{Message: []byte(strings.Repeat("x", 100)), Err: cause})
+	if !errors.Is(err, cause) {
+		t.Error("DecodeError doesn't unwrap to its cause")
+	}
+	if want := `codec: Failed to decode message "` + strings.Repeat("x", maxQuoted) + `"... (100 bytes): bad input`; err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+}
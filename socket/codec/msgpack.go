@@ -0,0 +1,251 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// MsgPack encodes values as MessagePack in binary messages, with the
+// default limits.
+var MsgPack Codec = &MsgPackCodec{}
+
+// MsgPackCodec encodes values as MessagePack. Structs become maps keyed by
+// field name, which the "msgpack" struct tag changes as the "json" tag does
+// for encoding/json. Times use the timestamp extension type.
+type MsgPackCodec struct {
+	Limits Limits
+}
+
+func (c *MsgPackCodec) Marshal(v any) ([]byte, error) {
+	return marshal(msgpackFormat{}, "msgpack", c.Limits, v)
+}
+
+func (c *MsgPackCodec) Unmarshal(data []byte, v any) error {
+	return unmarshal(msgpackFormat{}, "msgpack", c.Limits, data, v)
+}
+
+func (c *MsgPackCodec) Binary() bool {
+	return true
+}
+
+// msgpackTimestamp is the extension type of timestamps.
+const msgpackTimestamp = -1
+
+type msgpackFormat struct{}
+
+func (msgpackFormat) appendNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+func (msgpackFormat) appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+func (f msgpackFormat) appendInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return f.appendUint(b, uint64(v))
+	case v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(v))
+	case v >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+}
+
+func (msgpackFormat) appendUint(b []byte, v uint64) []byte {
+	switch {
+	case v <= 0x7f:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+}
+
+func (msgpackFormat) appendFloat32(b []byte, v float32) []byte {
+	return binary.BigEndian.AppendUint32(append(b, 0xca), math.Float32bits(v))
+}
+
+func (msgpackFormat) appendFloat64(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v))
+}
+
+// appendLength appends the header of a string, binary, array or map. The
+// codes are those of the 8, 16 and 32 bit lengths; fix is the code of the
+// short form holding up to fixMax elements, zero if there is none.
+func appendLength(b []byte, n int, fix byte, fixMax int, codes [3]byte) []byte {
+	switch {
+	case fix != 0 && n <= fixMax:
+		return append(b, fix|byte(n))
+	case codes[0] != 0 && n <= math.MaxUint8:
+		return append(b, codes[0], byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, codes[1]), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, codes[2]), uint32(n))
+}
+
+func (msgpackFormat) appendString(b []byte, s string) []byte {
+	return append(appendLength(b, len(s), 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb}), s...)
+}
+
+func (msgpackFormat) appendBytes(b []byte, p []byte) []byte {
+	return append(appendLength(b, len(p), 0, 0, [3]byte{0xc4, 0xc5, 0xc6}), p...)
+}
+
+func (msgpackFormat) appendArrayHeader(b []byte, n int) []byte {
+	return appendLength(b, n, 0x90, 15, [3]byte{0, 0xdc, 0xdd})
+}
+
+func (msgpackFormat) appendMapHeader(b []byte, n int) []byte {
+	return appendLength(b, n, 0x80, 15, [3]byte{0, 0xde, 0xdf})
+}
+
+func (msgpackFormat) appendTime(b []byte, t time.Time) []byte {
+	sec, nsec := t.Unix(), uint64(t.Nanosecond())
+	switch {
+	case nsec == 0 && sec >= 0 && sec <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd6, 0xff), uint32(sec))
+	case sec >= 0 && sec < 1<<34:
+		return binary.BigEndian.AppendUint64(append(b, 0xd7, 0xff), nsec<<34|uint64(sec))
+	}
+	b = binary.BigEndian.AppendUint32(append(b, 0xc7, 12, 0xff), uint32(nsec))
+	return binary.BigEndian.AppendUint64(b, uint64(sec))
+}
+
+func (msgpackFormat) readItem(d *decoder) (item, error) {
+	p, err := d.read(1)
+	if err != nil {
+		return item{}, err
+	}
+	code := p[0]
+
+	switch {
+	case code <= 0x7f:
+		return item{kind: kindUint, u: uint64(code)}, nil
+	case code >= 0xe0:
+		return item{kind: kindInt, i: int64(int8(code))}, nil
+	case code&0xf0 == 0x80:
+		return readContainer(d, kindMap, uint64(code&0x0f))
+	case code&0xf0 == 0x90:
+		return readContainer(d, kindArray, uint64(code&0x0f))
+	case code&0xe0 == 0xa0:
+		return readString(d, kindString, uint64(code&0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return item{kind: kindNil}, nil
+	case 0xc2, 0xc3:
+		return item{kind: kindBool, b: code == 0xc3}, nil
+	case 0xc4, 0xc5, 0xc6:
+		return readSized(d, 1<<(code-0xc4), func(n uint64) (item, error) { return readString(d, kindBytes, n) })
+	case 0xc7, 0xc8, 0xc9:
+		return readSized(d, 1<<(code-0xc7), func(n uint64) (item, error) { return readExt(d, n) })
+	case 0xca:
+		n, err := d.readUint(4)
+		return item{kind: kindFloat, f: float64(math.Float32frombits(uint32(n)))}, err
+	case 0xcb:
+		n, err := d.readUint(8)
+		return item{kind: kindFloat, f: math.Float64frombits(n)}, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.readUint(1 << (code - 0xcc))
+		return item{kind: kindUint, u: n}, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		n, err := d.readUint(size)
+		// Sign-extend the integer from its size.
+		shift := 64 - 8*size
+		v := int64(n<<shift) >> shift
+		if v >= 0 {
+			return item{kind: kindUint, u: uint64(v)}, err
+		}
+		return item{kind: kindInt, i: v}, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return readExt(d, 1<<(code-0xd4))
+	case 0xd9, 0xda, 0xdb:
+		return readSized(d, 1<<(code-0xd9), func(n uint64) (item, error) { return readString(d, kindString, n) })
+	case 0xdc, 0xdd:
+		return readSized(d, 2<<(code-0xdc), func(n uint64) (item, error) { return readContainer(d, kindArray, n) })
+	case 0xde, 0xdf:
+		return readSized(d, 2<<(code-0xde), func(n uint64) (item, error) { return readContainer(d, kindMap, n) })
+	}
+	return item{}, fmt.Errorf("codec: Invalid MessagePack type 0x%02x", code)
+}
+
+// readSized reads a length of size bytes and passes it to fn.
+func readSized(d *decoder, size int, fn func(n uint64) (item, error)) (item, error) {
+	n, err := d.readUint(size)
+	if err != nil {
+		return item{}, err
+	}
+	return fn(n)
+}
+
+func readString(d *decoder, kind itemKind, n uint64) (item, error) {
+	length, err := d.checkLength(n, 1)
+	if err != nil {
+		return item{}, err
+	}
+	s, err := d.read(length)
+	return item{kind: kind, s: s}, err
+}
+
+func readContainer(d *decoder, kind itemKind, n uint64) (item, error) {
+	// Map entries take at least two bytes, array elements one.
+	minSize := 1
+	if kind == kindMap {
+		minSize = 2
+	}
+	length, err := d.checkLength(n, minSize)
+	return item{kind: kind, n: length}, err
+}
+
+// readExt reads an extension of n bytes. Only timestamps can be decoded,
+// other extensions can only be skipped.
+func readExt(d *decoder, n uint64) (item, error) {
+	p, err := d.read(1)
+	if err != nil {
+		return item{}, err
+	}
+	if int8(p[0]) != msgpackTimestamp {
+		return readString(d, kindExt, n)
+	}
+
+	var sec, nsec uint64
+	switch n {
+	case 4:
+		sec, err = d.readUint(4)
+	case 8:
+		var v uint64
+		v, err = d.readUint(8)
+		sec, nsec = v&(1<<34-1), v>>34
+	case 12:
+		if nsec, err = d.readUint(4); err == nil {
+			sec, err = d.readUint(8)
+		}
+	default:
+		return item{}, fmt.Errorf("codec: Invalid MessagePack timestamp of %d bytes", n)
+	}
+	if err != nil {
+		return item{}, err
+	}
+	if nsec >= 1e9 {
+		return item{}, fmt.Errorf("codec: Invalid MessagePack timestamp")
+	}
+	return item{kind: kindTime, t: time.Unix(int64(sec), int64(nsec)).UTC()}, nil
+}
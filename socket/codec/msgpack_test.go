@@ -0,0 +1,103 @@
+package codec
+
+import (
+	"encoding/hex"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+var msgpackExamples = []struct {
+	hex        string
+	value      any
+	decodeOnly bool
+}{
+	{"00", int64(0), false},
+	{"7f", int64(127), false},
+	{"cc80", int64(128), false},
+	{"cd0100", int64(256), false},
+	{"ce00010000", int64(65536), false},
+	{"cf0000000100000000", int64(1 << 32), false},
+	{"cfffffffffffffffff", uint64(math.MaxUint64), false},
+	{"ff", int64(-1), false},
+	{"e0", int64(-32), false},
+	{"d0df", int64(-33), false},
+	{"d1ff7f", int64(-129), false},
+	{"d2ffff7fff", int64(-32769), false},
+	{"d3ffffffff7fffffff", int64(-2147483649), false},
+	{"d07f", int64(127), true},
+	{"c0", nil, false},
+	{"c2", false, false},
+	{"c3", true, false},
+	{"ca3fc00000", 1.5, true},
+	{"cb3ff8000000000000", 1.5, false},
+	{"a0", "", false},
+	{"a161", "a", false},
+	{"d920" + strings.Repeat("61", 32), strings.Repeat("a", 32), false},
+	{"da0003616263", "abc", true},
+	{"c4020102", []byte{1, 2}, false},
+	{"c500020102", []byte{1, 2}, true},
+	{"90", []any{}, false},
+	{"920102", []any{int64(1), int64(2)}, false},
+	{"dc00020102", []any{int64(1), int64(2)}, true},
+	{"80", map[string]any{}, false},
+	{"81a16101", map[string]any{"a": int64(1)}, false},
+	{"820102a16103", map[any]any{int64(1): int64(2), "a": int64(3)}, true},
+	{"d6ff00000001", time.Unix(1, 0).UTC(), false},
+	{"d7ff0000000400000001", time.Unix(1, 1).UTC(), false},
+	{"c70cff00000001ffffffffffffffff", time.Unix(-1, 1).UTC(), false},
+}
+
+func TestMsgPackExamples(t *testing.T) {
+	for _, ex := range msgpackExamples {
+		data, _ := hex.DecodeString(ex.hex)
+		var got any
+		if err := MsgPack.Unmarshal(data, &got); err != nil {
+			t.Errorf("decode %s: %v", ex.hex, err)
+			continue
+		}
+		if !equalValues(got, ex.value) {
+			t.Errorf("decode %s: got %#v, want %#v", ex.hex, got, ex.value)
+		}
+
+		if ex.decodeOnly {
+			continue
+		}
+		encoded, err := MsgPack.Marshal(ex.value)
+		if err != nil || hex.EncodeToString(encoded) != ex.hex {
+			t.Errorf("encode %#v: got %x and %v, want %s", ex.value, encoded, err, ex.hex)
+		}
+	}
+}
+
+func TestMsgPackInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"c1",         // never used
+		"cc",         // missing integer
+		"a261",       // string shorter than its length
+		"dbffffffff", // length beyond the message
+		"dc0002",     // missing elements
+		"d6ff",       // timestamp cut off
+		"d5ff0000",   // timestamp of two bytes
+		"d7ffffffffff00000000",
+		"d4010a", // other extensions can't be decoded
+		"0000",   // trailing data
+	} {
+		data, _ := hex.DecodeString(input)
+		var v any
+		if err := MsgPack.Unmarshal(data, &v); err == nil {
+			t.Errorf("decode %s: got %#v, want an error", input, v)
+		}
+	}
+
+	// Other extensions are skipped when their field is unknown.
+	data, _ := hex.DecodeString("82a178d4010aa17901")
+	var v struct {
+		Y int `msgpack:"y"`
+	}
+	if err := MsgPack.Unmarshal(data, &v); err != nil || v.Y != 1 {
+		t.Errorf("got %+v and %v, want the extension skipped", v, err)
+	}
+}
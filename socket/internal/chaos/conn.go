@@ -0,0 +1,33 @@
+// Package chaos wraps connections so that reads return their data in small
+// pieces, the way TCP may deliver it.
+package chaos
+
+import (
+	"math/rand/v2"
+	"net"
+)
+
+// Conn returns at most a few bytes from every Read.
+type Conn struct {
+	net.Conn
+	next func() int
+}
+
+// OneByte returns a connection whose reads return a single byte each.
+func OneByte(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, next: func() int { return 1 }}
+}
+
+// Random returns a connection whose reads return between 1 and max bytes,
+// chosen by a generator seeded with seed.
+func Random(conn net.Conn, seed uint64, max int) *Conn {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	return &Conn{Conn: conn, next: func() int { return rng.IntN(max) + 1 }}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if n := c.next(); len(p) > n {
+		p = p[:n]
+	}
+	return c.Conn.Read(p)
+}
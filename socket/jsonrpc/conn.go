@@ -0,0 +1,435 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	v13 "github.com/Walter-Sparrow/go-socket/socket/v13"
+)
+
+// ErrClosed is returned by calls once the connection is closed.
+var ErrClosed = errors.New("jsonrpc: Connection closed")
+
+// Conn is a JSON-RPC session over a WebSocket connection. Its methods may
+// be called from any goroutine.
+type Conn struct {
+	ws      *v13.Connection
+	methods *Methods
+
+	// ctx is the parent of the contexts of incoming calls and is cancelled
+	// when the connection closes.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan *message
+	// running cancels the contexts of incoming calls by request ID.
+	running map[string]context.CancelFunc
+	err     error
+	done    chan struct{}
+}
+
+type connKey struct{}
+
+// ConnFromContext returns the connection a method was called on, so it can
+// call back the peer.
+func ConnFromContext(ctx context.Context) *Conn {
+	c, _ := ctx.Value(connKey{}).(*Conn)
+	return c
+}
+
+// NewConn starts a session on ws serving methods, which may be nil. It takes
+// over reading from ws.
+func NewConn(ws *v13.Connection, methods *Methods) *Conn {
+	c := &Conn{
+		ws:      ws,
+		methods: methods,
+		pending: make(map[string]chan *message),
+		running: make(map[string]context.CancelFunc),
+		done:    make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.WithValue(context.Background(), connKey{}, c))
+	go c.readLoop()
+	return c
+}
+
+// Done returns a channel that is closed once the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection closed, nil while it is open.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close performs the closing handshake. Pending calls fail with ErrClosed
+// and the contexts of running methods are cancelled.
+func (c *Conn) Close() error {
+	err := c.ws.CloseWithReason(v13.CloseNormalClosure, "")
+	<-c.done
+	return err
+}
+
+// Call calls a method of the peer and decodes its result into result,
+// unless result is nil. An error response is returned as an *Error. If ctx
+// is done before the response arrives, Call returns ctx.Err(), the response
+// is dropped and the peer is asked to cancel the call with CancelMethod.
+func (c *Conn) Call(ctx context.Context, method string, params, result any) error {
+	call := &BatchCall{Method: method, Params: params, Result: result}
+	if err := c.Batch(ctx, call); err != nil {
+		return err
+	}
+	return call.Error
+}
+
+// Notify sends a notification, which the peer doesn't answer.
+func (c *Conn) Notify(ctx context.Context, method string, params any) error {
+	return c.Batch(ctx, &BatchCall{Method: method, Params: params, Notification: true})
+}
+
+// BatchCall is one call of a batch.
+type BatchCall struct {
+	Method string
+	Params any
+	// Result receives the decoded result, unless it is nil.
+	Result any
+	// Notification sends the call as a notification, without a response.
+	Notification bool
+	// Error is set after the batch to the error of the call, an *Error if
+	// the peer answered with one.
+	Error error
+}
+
+// Batch sends calls together and waits for all their responses. A single
+// call is sent on its own rather than as a batch of one. The error of the
+// batch is about sending it or waiting for it; the outcome of each call is
+// in its Error field.
+func (c *Conn) Batch(ctx context.Context, calls ...*BatchCall) error {
+	if len(calls) == 0 {
+		return fmt.Errorf("jsonrpc: Empty batch")
+	}
+
+	requests := make([]message, len(calls))
+	ids := make([]string, len(calls))
+	responses := make([]chan *message, len(calls))
+	for i, call := range calls {
+		requests[i] = message{JSONRPC: version, Method: call.Method}
+		if call.Params != nil {
+			params, err := json.Marshal(call.Params)
+			if err != nil {
+				return fmt.Errorf("jsonrpc: Failed to encode params of %s: %w", call.Method, err)
+			}
+			requests[i].Params = params
+		}
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	for i, call := range calls {
+		if call.Notification {
+			continue
+		}
+		c.nextID++
+		ids[i] = strconv.FormatUint(c.nextID, 10)
+		requests[i].ID = json.RawMessage(ids[i])
+		responses[i] = make(chan *message, 1)
+		c.pending[ids[i]] = responses[i]
+	}
+	c.mu.Unlock()
+	defer c.forget(ids)
+
+	var data []byte
+	var err error
+	if len(requests) == 1 {
+		data, err = json.Marshal(requests[0])
+	} else {
+		data, err = json.Marshal(requests)
+	}
+	if err == nil {
+		err = c.ws.WriteContext(ctx, v13.OpText, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, call := range calls {
+		if call.Notification {
+			continue
+		}
+
+		var response *message
+		select {
+		case response = <-responses[i]:
+		case <-ctx.Done():
+			c.abandon(ids[i:])
+			return ctx.Err()
+		case <-c.done:
+			// A response may have arrived just before the connection
+			// closed.
+			select {
+			case response = <-responses[i]:
+			default:
+				call.Error = ErrClosed
+				continue
+			}
+		}
+
+		switch {
+		case response.Error != nil:
+			call.Error = response.Error
+		case call.Result != nil:
+			if err := json.Unmarshal(response.Result, call.Result); err != nil {
+				call.Error = fmt.Errorf("jsonrpc: Failed to decode result of %s: %w", call.Method, err)
+			}
+		}
+	}
+	return nil
+}
+
+// abandon asks the peer to cancel those calls of ids that are still waiting
+// for their response.
+func (c *Conn) abandon(ids []string) {
+	var notifications []*message
+	c.mu.Lock()
+	for _, id := range ids {
+		if _, ok := c.pending[id]; !ok {
+			continue
+		}
+		params, _ := json.Marshal(cancelParams{ID: json.RawMessage(id)})
+		notifications = append(notifications, &message{JSONRPC: version, Method: CancelMethod, Params: params})
+	}
+	c.mu.Unlock()
+
+	// The caller doesn't wait for the notifications to go out.
+	switch len(notifications) {
+	case 0:
+	case 1:
+		go c.reply(notifications[0])
+	default:
+		go c.reply(notifications)
+	}
+}
+
+// forget drops the pending calls of ids.
+func (c *Conn) forget(ids []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		delete(c.pending, id)
+	}
+}
+
+func (c *Conn) readLoop() {
+	var err error
+	for {
+		var data []byte
+		if _, data, err = c.ws.Read(); err != nil {
+			break
+		}
+		c.handle(data)
+	}
+
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+	c.cancel()
+	close(c.done)
+	c.ws.Close()
+}
+
+// handle dispatches a received message or batch. Responses are delivered
+// to their calls, requests run in their own goroutine.
+func (c *Conn) handle(data []byte) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			c.reply(&message{JSONRPC: version, ID: nullID, Error: &Error{Code: CodeParseError, Message: err.Error()}})
+			return
+		}
+		if len(batch) == 0 {
+			c.reply(&message{JSONRPC: version, ID: nullID, Error: &Error{Code: CodeInvalidRequest, Message: "Empty batch"}})
+			return
+		}
+		go c.handleBatch(batch)
+		return
+	}
+
+	var m message
+	if err := json.Unmarshal(data, &m); err != nil {
+		c.reply(&message{JSONRPC: version, ID: nullID, Error: &Error{Code: CodeParseError, Message: err.Error()}})
+		return
+	}
+	if c.deliver(&m) {
+		return
+	}
+	go func() {
+		if response := c.serve(&m); response != nil {
+			c.reply(response)
+		}
+	}()
+}
+
+// handleBatch answers a batch with the responses to its requests, in the
+// same order, once all of them are done.
+func (c *Conn) handleBatch(batch []json.RawMessage) {
+	responses := make([]*message, len(batch))
+	var wg sync.WaitGroup
+	for i, raw := range batch {
+		var m message
+		if err := json.Unmarshal(raw, &m); err != nil {
+			responses[i] = &message{JSONRPC: version, ID: nullID, Error: &Error{Code: CodeInvalidRequest, Message: err.Error()}}
+			continue
+		}
+		if c.deliver(&m) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = c.serve(&m)
+		}()
+	}
+	wg.Wait()
+
+	var answers []*message
+	for _, response := range responses {
+		if response != nil {
+			answers = append(answers, response)
+		}
+	}
+	// A batch of notifications gets no response at all.
+	if len(answers) > 0 {
+		c.reply(answers)
+	}
+}
+
+// deliver hands a response to the call waiting for it and reports whether
+// m was a response.
+func (c *Conn) deliver(m *message) bool {
+	if m.Method != "" || (m.Result == nil && m.Error == nil) {
+		return false
+	}
+
+	c.mu.Lock()
+	response := c.pending[string(m.ID)]
+	delete(c.pending, string(m.ID))
+	c.mu.Unlock()
+	// Responses to calls that gave up are dropped.
+	if response != nil {
+		response <- m
+	}
+	return true
+}
+
+// serve runs the method of a request and returns the response, nil for
+// notifications.
+func (c *Conn) serve(m *message) *message {
+	notification := len(m.ID) == 0
+	response := &message{JSONRPC: version, ID: m.ID}
+
+	if m.JSONRPC != version || m.Method == "" || !validID(m.ID) {
+		response.ID = nullID
+		if validID(m.ID) && !notification {
+			response.ID = m.ID
+		}
+		response.Error = &Error{Code: CodeInvalidRequest, Message: "Invalid request"}
+		return response
+	}
+
+	if m.Method == CancelMethod {
+		c.cancelRunning(m.Params)
+		if notification {
+			return nil
+		}
+		response.Result = json.RawMessage("null")
+		return response
+	}
+
+	h := c.methods.lookup(m.Method)
+	if h == nil {
+		if notification {
+			return nil
+		}
+		response.Error = &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("Method %q not found", m.Method)}
+		return response
+	}
+
+	ctx := c.ctx
+	if !notification {
+		// Each call gets its own context, so the peer can cancel it.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(c.ctx)
+		id := string(m.ID)
+		c.mu.Lock()
+		c.running[id] = cancel
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.running, id)
+			c.mu.Unlock()
+			cancel()
+		}()
+	}
+
+	result, err := h(ctx, m.Params)
+	if notification {
+		return nil
+	}
+	if err != nil {
+		response.Error = toError(err)
+		return response
+	}
+	if response.Result, err = json.Marshal(result); err != nil {
+		response.Error = &Error{Code: CodeInternalError, Message: fmt.Sprintf("Failed to encode result: %v", err)}
+	}
+	return response
+}
+
+// cancelRunning cancels the incoming call named by the params of a
+// CancelMethod notification. Calls that already finished are ignored.
+func (c *Conn) cancelRunning(params json.RawMessage) {
+	var p cancelParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return
+	}
+	c.mu.Lock()
+	cancel := c.running[string(p.ID)]
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// validID reports whether id is absent, a string, a number or null.
+func validID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+func (c *Conn) reply(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	// The connection may be closing, its read loop notices.
+	c.ws.Write(v13.OpText, data)
+}
@@ -0,0 +1,121 @@
+// Package jsonrpc implements JSON-RPC 2.0 over v13 WebSocket connections.
+//
+// Both ends of a connection are peers: each serves the methods registered
+// with its Methods and may call the methods of the other end, so servers can
+// call their clients in the same session. Connections negotiate the
+// "jsonrpc" subprotocol.
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Error codes defined by the JSON-RPC 2.0 specification.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// Error is the error object of a response. Handlers return it to choose the
+// code and data sent to the caller; other errors are sent with
+// CodeInternalError. Calls return it when the peer answered with an error.
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc: Error %d: %s", e.Code, e.Message)
+}
+
+// NewError returns an error object with data encoded as JSON, if not nil.
+func NewError(code int, message string, data any) *Error {
+	e := &Error{Code: code, Message: message}
+	if data != nil {
+		e.Data, _ = json.Marshal(data)
+	}
+	return e
+}
+
+// toError turns an error returned by a handler into an error object.
+func toError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: CodeInternalError, Message: err.Error()}
+}
+
+// handler decodes the params and runs a registered method.
+type handler func(ctx context.Context, params json.RawMessage) (any, error)
+
+// Methods holds the methods a peer serves. The zero value is an empty set,
+// ready to use.
+type Methods struct {
+	mu       sync.RWMutex
+	handlers map[string]handler
+}
+
+// Register adds a method to m. The params of a call are decoded from JSON
+// into P, a call without params gets the zero value; params that don't
+// decode are answered with CodeInvalidParams. The result is encoded as JSON.
+// Registering a name again replaces the method.
+func Register[P, R any](m *Methods, name string, fn func(ctx context.Context, params P) (R, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.handlers == nil {
+		m.handlers = make(map[string]handler)
+	}
+	m.handlers[name] = func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var params P
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+		}
+		return fn(ctx, params)
+	}
+}
+
+func (m *Methods) lookup(name string) handler {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.handlers[name]
+}
+
+// message is a request, notification or response.
+type message struct {
+	JSONRPC string `json:"jsonrpc"`
+	// ID is missing in notifications and null in responses to requests
+	// whose ID couldn't be read.
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+const version = "2.0"
+
+// CancelMethod is the notification a Conn sends when a call it made is
+// abandoned because its context is done. Its params hold the ID of the call,
+// as in {"id": 7}, and the peer cancels the context of the method serving it.
+const CancelMethod = "$/cancelRequest"
+
+type cancelParams struct {
+	ID json.RawMessage `json:"id"`
+}
+
+var nullID = json.RawMessage("null")
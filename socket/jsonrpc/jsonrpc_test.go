@@ -0,0 +1,307 @@
+package jsonrpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v13 "github.com/Walter-Sparrow/go-socket/socket/v13"
+)
+
+type sumParams struct {
+	A, B int
+}
+
+// serve starts a server with methods and dials it, serving clientMethods.
+// The server's end of the connection is sent on the returned channel.
+func serve(t *testing.T, methods, clientMethods *Methods) (*Conn, <-chan *Conn) {
+	servers := make(chan *Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(nil, w, r, methods)
+		if err != nil {
+			return
+		}
+		servers <- c
+	}))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	c, err := Dial(context.Background(), url, nil, clientMethods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, servers
+}
+
+func testMethods() *Methods {
+	methods := &Methods{}
+	Register(methods, "sum", func(ctx context.Context, p sumParams) (int, error) {
+		return p.A + p.B, nil
+	})
+	Register(methods, "concat", func(ctx context.Context, p []string) (string, error) {
+		return strings.Join(p, ""), nil
+	})
+	Register(methods, "fail", func(ctx context.Context, p struct{}) (any, error) {
+		return nil, NewError(42, "Failed on purpose", map[string]int{"attempt": 1})
+	})
+	Register(methods, "panicky", func(ctx context.Context, p struct{}) (any, error) {
+		return nil, errors.New("something broke")
+	})
+	Register(methods, "sleep", func(ctx context.Context, p struct{}) (any, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	return methods
+}
+
+func TestCall(t *testing.T) {
+	c, _ := serve(t, testMethods(), nil)
+	ctx := context.Background()
+
+	var sum int
+	if err := c.Call(ctx, "sum", sumParams{2, 3}, &sum); err != nil || sum != 5 {
+		t.Errorf("sum: got %d and %v", sum, err)
+	}
+	var s string
+	if err := c.Call(ctx, "concat", []string{"a", "b", "c"}, &s); err != nil || s != "abc" {
+		t.Errorf("concat: got %q and %v", s, err)
+	}
+
+	var rpcErr *Error
+	err := c.Call(ctx, "fail", nil, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != 42 || string(rpcErr.Data) != `{"attempt":1}` {
+		t.Errorf("fail: got %v", err)
+	}
+	for method, code := range map[string]int{
+		"missing": CodeMethodNotFound,
+		"panicky": CodeInternalError,
+	} {
+		if err := c.Call(ctx, method, nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != code {
+			t.Errorf("%s: got %v, want code %d", method, err, code)
+		}
+	}
+	if err := c.Call(ctx, "sum", "not an object", nil); !errors.As(err, &rpcErr) || rpcErr.Code != CodeInvalidParams {
+		t.Errorf("invalid params: got %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	notified := make(chan string, 1)
+	methods := testMethods()
+	Register(methods, "notify", func(ctx context.Context, p string) (any, error) {
+		notified <- p
+		return nil, nil
+	})
+	c, _ := serve(t, methods, nil)
+
+	var sum int
+	var s string
+	calls := []*BatchCall{
+		{Method: "sum", Params: sumParams{1, 1}, Result: &sum},
+		{Method: "notify", Params: "hello", Notification: true},
+		{Method: "missing"},
+		{Method: "concat", Params: []string{"x", "y"}, Result: &s},
+	}
+	if err := c.Batch(context.Background(), calls...); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 2 || calls[0].Error != nil {
+		t.Errorf("sum: got %d and %v", sum, calls[0].Error)
+	}
+	if s != "xy" || calls[3].Error != nil {
+		t.Errorf("concat: got %q and %v", s, calls[3].Error)
+	}
+	var rpcErr *Error
+	if !errors.As(calls[2].Error, &rpcErr) || rpcErr.Code != CodeMethodNotFound {
+		t.Errorf("missing: got %v", calls[2].Error)
+	}
+	if p := <-notified; p != "hello" {
+		t.Errorf("notification: got %q", p)
+	}
+
+	if err := c.Notify(context.Background(), "notify", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-notified; p != "again" {
+		t.Errorf("notification: got %q", p)
+	}
+}
+
+// TestInvalidMessages checks the responses to raw messages.
+func TestInvalidMessages(t *testing.T) {
+	tests := []struct {
+		request, response string
+	}{
+		{`{"jsonrpc":"2.0","method":"sum","params":{"A":1,"B":2},"id":"a"}`, `{"jsonrpc":"2.0","id":"a","result":3}`},
+		{`{"jsonrpc":"2.0","method":"sum","params":{"A":1,"B":2}`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,`},
+		{`{"jsonrpc":"1.0","method":"sum","id":1}`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32600,`},
+		{`{"jsonrpc":"2.0","method":"sum","id":{}}`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,`},
+		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,`},
+		{`[1]`, `[{"jsonrpc":"2.0","id":null,"error":{"code":-32600,`},
+		{`[{"jsonrpc":"2.0","method":"sum","params":{"A":1},"id":1},{"jsonrpc":"2.0","method":"sum"}]`, `[{"jsonrpc":"2.0","id":1,"result":1}]`},
+	}
+	for _, tt := range tests {
+		c := rawDial(t)
+		if err := c.Write(v13.OpText, []byte(tt.request)); err != nil {
+			t.Fatal(err)
+		}
+		_, response, err := c.Read()
+		if err != nil || !strings.HasPrefix(string(response), tt.response) {
+			t.Errorf("%s: got %s and %v, want %s...", tt.request, response, err, tt.response)
+		}
+		c.Close()
+	}
+}
+
+// rawDial connects to a server without the jsonrpc package on the client
+// side.
+func rawDial(t *testing.T) *v13.Connection {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Upgrade(nil, w, r, testMethods())
+	}))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	c, err := v13.Dial(context.Background(), url, &v13.DialOptions{Subprotocols: []string{Subprotocol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestServerCallsClient(t *testing.T) {
+	clientMethods := &Methods{}
+	Register(clientMethods, "greet", func(ctx context.Context, name string) (string, error) {
+		return "hello " + name, nil
+	})
+	methods := &Methods{}
+	Register(methods, "callback", func(ctx context.Context, name string) (string, error) {
+		var greeting string
+		err := ConnFromContext(ctx).Call(ctx, "greet", name, &greeting)
+		return greeting, err
+	})
+	c, servers := serve(t, methods, clientMethods)
+
+	var greeting string
+	if err := c.Call(context.Background(), "callback", "world", &greeting); err != nil || greeting != "hello world" {
+		t.Errorf("got %q and %v", greeting, err)
+	}
+
+	server := <-servers
+	if err := server.Call(context.Background(), "greet", "server", &greeting); err != nil || greeting != "hello server" {
+		t.Errorf("got %q and %v", greeting, err)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	c, servers := serve(t, testMethods(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Call(ctx, "sleep", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	// The connection is still usable after a call gave up.
+	var sum int
+	if err := c.Call(context.Background(), "sum", sumParams{1, 2}, &sum); err != nil || sum != 3 {
+		t.Errorf("sum: got %d and %v", sum, err)
+	}
+
+	// Running methods are cancelled and pending calls fail when the
+	// connection closes.
+	server := <-servers
+	result := make(chan error, 1)
+	go func() { result <- c.Call(context.Background(), "sleep", nil, nil) }()
+	time.Sleep(50 * time.Millisecond)
+	server.Close()
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("got %v, want ErrClosed", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("pending call didn't fail")
+	}
+	if err := c.Call(context.Background(), "sum", nil, nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v after close, want ErrClosed", err)
+	}
+}
+
+// TestCancelCall checks that a call that gave up cancels the context of the
+// method serving it, and only that one.
+func TestCancelCall(t *testing.T) {
+	started := make(chan string, 2)
+	cancelled := make(chan string, 2)
+	methods := &Methods{}
+	Register(methods, "wait", func(ctx context.Context, name string) (any, error) {
+		started <- name
+		<-ctx.Done()
+		cancelled <- name
+		return nil, ctx.Err()
+	})
+	finished := make(chan context.Context, 1)
+	Register(methods, "quick", func(ctx context.Context, p struct{}) (any, error) {
+		finished <- ctx
+		return nil, nil
+	})
+	c, _ := serve(t, methods, nil)
+
+	go c.Call(context.Background(), "wait", "other", nil)
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if err := c.Call(ctx, "wait", "abandoned", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	select {
+	case name := <-cancelled:
+		if name != "abandoned" {
+			t.Errorf("cancelled %q, want the abandoned call", name)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("method of the abandoned call was not cancelled")
+	}
+
+	// The context of a call ends when its method returns.
+	if err := c.Call(context.Background(), "quick", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ctx := <-finished; ctx.Err() == nil {
+		t.Error("context of a finished call is not done")
+	}
+	select {
+	case name := <-cancelled:
+		t.Errorf("%q was cancelled as well", name)
+	default:
+	}
+}
+
+func TestSubprotocol(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Upgrade(nil, w, r, nil)
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	if _, err := v13.Dial(context.Background(), url, nil); err == nil {
+		t.Error("upgraded a client that didn't offer the subprotocol")
+	}
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := v13.Upgrade(w, r); err == nil {
+			c.Read()
+		}
+	}))
+	defer plain.Close()
+	if _, err := Dial(context.Background(), "ws"+strings.TrimPrefix(plain.URL, "http"), nil, nil); err == nil {
+		t.Error("connected to a server that didn't select the subprotocol")
+	}
+}
@@ -0,0 +1,55 @@
+package jsonrpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	v13 "github.com/Walter-Sparrow/go-socket/socket/v13"
+)
+
+// Subprotocol is the WebSocket subprotocol of JSON-RPC connections.
+const Subprotocol = "jsonrpc"
+
+// Upgrade upgrades the request to a JSON-RPC session serving methods. The
+// options of u are used, with the subprotocol set to "jsonrpc"; a nil u
+// stands for a zero v13.Upgrader. Requests not offering the subprotocol are
+// answered with 400 Bad Request.
+func Upgrade(u *v13.Upgrader, w http.ResponseWriter, r *http.Request, methods *Methods) (*Conn, error) {
+	if !slices.Contains(v13.Subprotocols(r), Subprotocol) {
+		http.Error(w, "Missing the jsonrpc subprotocol", http.StatusBadRequest)
+		return nil, fmt.Errorf("jsonrpc: Client didn't offer the %s subprotocol", Subprotocol)
+	}
+
+	var upgrader v13.Upgrader
+	if u != nil {
+		upgrader = *u
+	}
+	upgrader.Subprotocols = []string{Subprotocol}
+	ws, err := upgrader.Upgrade(w, r)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(ws, methods), nil
+}
+
+// Dial connects to a JSON-RPC server, offering the "jsonrpc" subprotocol, and
+// serves methods to it. opts may be nil.
+func Dial(ctx context.Context, url string, opts *v13.DialOptions, methods *Methods) (*Conn, error) {
+	var o v13.DialOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.Subprotocols = []string{Subprotocol}
+
+	ws, err := v13.Dial(ctx, url, &o)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Subprotocol() != Subprotocol {
+		ws.CloseWithReason(v13.ClosePolicyViolation, "Missing the jsonrpc subprotocol")
+		return nil, fmt.Errorf("jsonrpc: Server didn't select the %s subprotocol", Subprotocol)
+	}
+	return NewConn(ws, methods), nil
+}
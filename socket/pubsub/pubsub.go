@@ -0,0 +1,274 @@
+// Package pubsub delivers messages to v13 connections by topic.
+//
+// Topics are made of segments separated by '.' or '/', such as "orders.eu"
+// or "chat/42". Connections join topics or patterns: in a pattern, a "*"
+// segment matches any single segment and a trailing "#" segment matches one
+// or more segments, so "orders.*" matches "orders.eu" and "chat/#" matches
+// "chat/42" and "chat/42/typing". Separators must match exactly.
+package pubsub
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	v13 "github.com/Walter-Sparrow/go-socket/socket/v13"
+)
+
+// Broker keeps track of the topics connections joined. Connections leave
+// all their topics once they are closed, which happens when their Read
+// returns an error. The zero value is a valid Broker.
+type Broker struct {
+	// Hub queues the messages for the connections, its options decide
+	// what happens with slow ones. When nil, the first Join sets it to a Hub
+	// with default options. Connections are registered with it while they
+	// are members of a topic, so Hub.Broadcast reaches all of them;
+	// connections the application registered itself stay registered.
+	Hub *v13.Hub
+
+	mu sync.Mutex
+	// topics maps topics and patterns to their members.
+	topics map[string]map[*v13.Connection]struct{}
+	// patterns holds the topics containing wildcards.
+	patterns map[string]struct{}
+	members  map[*v13.Connection]*member
+}
+
+type member struct {
+	topics map[string]struct{}
+	// stop ends the goroutine waiting for the connection to close.
+	stop chan struct{}
+	// registered is set when Join registered the connection with the Hub,
+	// rather than the application.
+	registered bool
+}
+
+// Join subscribes c to a topic or pattern.
+func (b *Broker) Join(c *v13.Connection, topic string) error {
+	wildcard, err := parseTopic(topic, true)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.members == nil {
+		b.topics = make(map[string]map[*v13.Connection]struct{})
+		b.patterns = make(map[string]struct{})
+		b.members = make(map[*v13.Connection]*member)
+	}
+	if b.Hub == nil {
+		b.Hub = &v13.Hub{}
+	}
+
+	m := b.members[c]
+	if m == nil {
+		m = &member{
+			topics:     make(map[string]struct{}),
+			stop:       make(chan struct{}),
+			registered: b.Hub.Register(c),
+		}
+		b.members[c] = m
+		go b.leaveOnClose(c, m.stop)
+	}
+	m.topics[topic] = struct{}{}
+
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[*v13.Connection]struct{})
+		if wildcard {
+			b.patterns[topic] = struct{}{}
+		}
+	}
+	b.topics[topic][c] = struct{}{}
+	return nil
+}
+
+// Leave unsubscribes c from a topic or pattern. It has to match the one
+// passed to Join exactly.
+func (b *Broker) Leave(c *v13.Connection, topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := b.members[c]
+	if m == nil {
+		return
+	}
+	if _, ok := m.topics[topic]; !ok {
+		return
+	}
+	b.leave(c, topic)
+	delete(m.topics, topic)
+	if len(m.topics) == 0 {
+		b.removeMember(c, m)
+	}
+}
+
+// LeaveAll unsubscribes c from every topic and pattern.
+func (b *Broker) LeaveAll(c *v13.Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := b.members[c]
+	if m == nil {
+		return
+	}
+	for topic := range m.topics {
+		b.leave(c, topic)
+	}
+	b.removeMember(c, m)
+}
+
+// removeMember forgets c once it left its last topic. c stays registered
+// with the Hub if the application registered it.
+func (b *Broker) removeMember(c *v13.Connection, m *member) {
+	close(m.stop)
+	delete(b.members, c)
+	if m.registered {
+		b.Hub.Unregister(c)
+	}
+}
+
+func (b *Broker) leave(c *v13.Connection, topic string) {
+	delete(b.topics[topic], c)
+	if len(b.topics[topic]) == 0 {
+		delete(b.topics, topic)
+		delete(b.patterns, topic)
+	}
+}
+
+func (b *Broker) leaveOnClose(c *v13.Connection, stop chan struct{}) {
+	select {
+	case <-c.Done():
+		b.LeaveAll(c)
+	case <-stop:
+	}
+}
+
+// Topics returns the topics and patterns that have members.
+func (b *Broker) Topics() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topics := make([]string, 0, len(b.topics))
+	for topic := range b.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Count returns the number of connections a message published to topic
+// would reach, counting the members of matching patterns.
+func (b *Broker) Count(topic string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.recipients(topic))
+}
+
+// Publish queues a text or binary message for every connection that joined
+// topic or a pattern matching it and returns how many there are. topic must
+// not contain wildcards.
+func (b *Broker) Publish(topic string, messageType byte, message []byte) (int, error) {
+	if wildcard, err := parseTopic(topic, false); err != nil {
+		return 0, err
+	} else if wildcard {
+		return 0, fmt.Errorf("pubsub: Cannot publish to pattern %q", topic)
+	}
+
+	b.mu.Lock()
+	conns := b.recipients(topic)
+	hub := b.Hub
+	b.mu.Unlock()
+
+	if len(conns) == 0 {
+		return 0, nil
+	}
+	if err := hub.BroadcastTo(messageType, message, conns...); err != nil {
+		return 0, err
+	}
+	return len(conns), nil
+}
+
+func (b *Broker) recipients(topic string) []*v13.Connection {
+	var conns []*v13.Connection
+	for c := range b.topics[topic] {
+		conns = append(conns, c)
+	}
+
+	// A connection matching several patterns gets the message once.
+	var seen map[*v13.Connection]struct{}
+	for pattern := range b.patterns {
+		if !match(pattern, topic) {
+			continue
+		}
+		if seen == nil {
+			seen = make(map[*v13.Connection]struct{}, len(conns))
+			for _, c := range conns {
+				seen[c] = struct{}{}
+			}
+		}
+		for c := range b.topics[pattern] {
+			if _, ok := seen[c]; !ok {
+				seen[c] = struct{}{}
+				conns = append(conns, c)
+			}
+		}
+	}
+	return conns
+}
+
+// parseTopic checks that topic is made of non-empty segments and reports
+// whether it contains wildcards.
+func parseTopic(topic string, allowWildcards bool) (wildcard bool, err error) {
+	rest := topic
+	for {
+		segment, sep, last := nextSegment(rest)
+		switch {
+		case segment == "":
+			return false, fmt.Errorf("pubsub: Invalid topic %q", topic)
+		case segment == "*" || segment == "#":
+			if !allowWildcards || (segment == "#" && !last) {
+				return false, fmt.Errorf("pubsub: Invalid wildcard in topic %q", topic)
+			}
+			wildcard = true
+		case strings.ContainsAny(segment, "*#"):
+			return false, fmt.Errorf("pubsub: Invalid wildcard in topic %q", topic)
+		}
+		if last {
+			return wildcard, nil
+		}
+		rest = rest[len(segment)+len(sep):]
+	}
+}
+
+// nextSegment splits off the first segment of topic and the separator
+// following it.
+func nextSegment(topic string) (segment, sep string, last bool) {
+	i := strings.IndexAny(topic, "./")
+	if i < 0 {
+		return topic, "", true
+	}
+	return topic[:i], topic[i : i+1], false
+}
+
+// match reports whether topic matches pattern.
+func match(pattern, topic string) bool {
+	for {
+		p, psep, plast := nextSegment(pattern)
+		if p == "#" {
+			return topic != ""
+		}
+		t, tsep, tlast := nextSegment(topic)
+		if p != "*" && p != t {
+			return false
+		}
+		if plast || tlast {
+			return plast && tlast
+		}
+		if psep != tsep {
+			return false
+		}
+		pattern = pattern[len(p)+1:]
+		topic = topic[len(t)+1:]
+	}
+}
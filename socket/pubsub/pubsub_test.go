@@ -0,0 +1,198 @@
+package pubsub
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	v13 "github.com/Walter-Sparrow/go-socket/socket/v13"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"orders.eu", "orders.eu", true},
+		{"orders.eu", "orders.us", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.eu.paid", false},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders/eu", false},
+		{"*.eu", "orders.eu", true},
+		{"chat/#", "chat/42", true},
+		{"chat/#", "chat/42/typing", true},
+		{"chat/#", "chat", false},
+		{"chat/#", "chat.42", false},
+		{"chat/*/typing", "chat/42/typing", true},
+		{"#", "anything/at.all", true},
+	}
+	for _, tt := range tests {
+		if got := match(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestParseTopic(t *testing.T) {
+	for _, topic := range []string{"", "orders.", ".eu", "chat//42", "chat/#/typing", "orders.e*", "chat/4#"} {
+		if _, err := parseTopic(topic, true); err == nil {
+			t.Errorf("topic %q was accepted", topic)
+		}
+	}
+	if _, err := parseTopic("orders.*", false); err == nil {
+		t.Error("pattern was accepted where wildcards are not allowed")
+	}
+}
+
+// connect dials n connections to a server that hands its ends to the test
+// and reads from them until they fail.
+func connect(t *testing.T, n int) (servers, clients []*v13.Connection) {
+	return connectWith(t, n, v13.Upgrade)
+}
+
+// connectWith is connect with the server upgrading requests by upgrade.
+func connectWith(t *testing.T, n int, upgrade func(w http.ResponseWriter, r *http.Request) (*v13.Connection, error)) (servers, clients []*v13.Connection) {
+	conns := make(chan *v13.Connection)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrade(w, r)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- c
+		for {
+			if _, _, err := c.Read(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	for i := 0; i < n; i++ {
+		c, err := v13.Dial(context.Background(), url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		clients = append(clients, c)
+		servers = append(servers, <-conns)
+	}
+	return servers, clients
+}
+
+// expect checks that c receives exactly the given messages.
+func expect(t *testing.T, c *v13.Connection, want ...string) {
+	t.Helper()
+	var got []string
+	for {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, message, err := c.Read()
+		if err != nil {
+			break
+		}
+		got = append(got, string(message))
+	}
+	c.SetReadDeadline(time.Time{})
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	servers, clients := connect(t, 3)
+	b := &Broker{}
+	b.Join(servers[0], "orders.eu")
+	b.Join(servers[1], "orders.*")
+	b.Join(servers[1], "orders.eu")
+	b.Join(servers[2], "chat/#")
+
+	for _, tt := range []struct {
+		topic string
+		want  int
+	}{
+		{"orders.eu", 2},
+		{"orders.us", 1},
+		{"chat/42/typing", 1},
+		{"news", 0},
+	} {
+		if n := b.Count(tt.topic); n != tt.want {
+			t.Errorf("count of %q = %d, want %d", tt.topic, n, tt.want)
+		}
+		if n, err := b.Publish(tt.topic, v13.OpText, []byte(tt.topic)); err != nil || n != tt.want {
+			t.Errorf("publish to %q reached %d and failed with %v, want %d", tt.topic, n, err, tt.want)
+		}
+	}
+	expect(t, clients[0], "orders.eu")
+	expect(t, clients[1], "orders.eu", "orders.us")
+	expect(t, clients[2], "chat/42/typing")
+
+	if _, err := b.Publish("orders.*", v13.OpText, nil); err == nil {
+		t.Error("publish to a pattern succeeded")
+	}
+	if err := b.Join(servers[0], "orders..eu"); err == nil {
+		t.Error("join of an invalid topic succeeded")
+	}
+
+	b.Leave(servers[1], "orders.*")
+	b.Publish("orders.us", v13.OpText, []byte("again"))
+	expect(t, clients[1])
+	if n := b.Count("orders.eu"); n != 2 {
+		t.Errorf("count after leaving the pattern = %d, want 2", n)
+	}
+
+	b.LeaveAll(servers[1])
+	if n := b.Count("orders.eu"); n != 1 {
+		t.Errorf("count after leaving all topics = %d, want 1", n)
+	}
+
+	// Connections without topics leave the hub as well.
+	b.Leave(servers[2], "chat/#")
+	if n := b.Hub.Len(); n != 1 {
+		t.Errorf("hub has %d connections, want 1", n)
+	}
+	b.Hub.Broadcast(v13.OpText, []byte("broadcast"))
+	expect(t, clients[0], "broadcast")
+	expect(t, clients[1])
+	expect(t, clients[2])
+}
+
+func TestLeaveOnClose(t *testing.T) {
+	servers, clients := connect(t, 2)
+	b := &Broker{}
+	b.Join(servers[0], "chat/42")
+	b.Join(servers[0], "chat/#")
+	b.Join(servers[1], "chat/42")
+
+	// The server's Read fails once the client is gone.
+	clients[0].Close()
+	for deadline := time.Now().Add(time.Second); b.Count("chat/42") != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("closed connection is still a member of %q", b.Topics())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if topics := b.Topics(); !slices.Equal(topics, []string{"chat/42"}) {
+		t.Errorf("topics = %q, want [chat/42]", topics)
+	}
+}
+
+func TestHubRegistration(t *testing.T) {
+	hub := &v13.Hub{}
+	servers, clients := connectWith(t, 1, hub.Upgrade)
+	b := &Broker{Hub: hub}
+	b.Join(servers[0], "news")
+	b.Leave(servers[0], "news")
+
+	// The connection was registered by the application, not the Broker.
+	if n := hub.Len(); n != 1 {
+		t.Fatalf("hub has %d connections, want 1", n)
+	}
+	hub.Broadcast(v13.OpText, []byte("broadcast"))
+	expect(t, clients[0], "broadcast")
+}
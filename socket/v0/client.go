@@ -1,6 +1,7 @@
 package v0
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/md5"
 	"encoding/binary"
@@ -13,12 +14,21 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 )
 
 type Client struct {
 	conn    net.Conn
+	br      *bufio.Reader
 	closing bool
+	// reading is set while a message is partly read.
+	reading bool
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
 }
 
 func NewClient(address string, pattern string, headers http.Header) (*Client, error) {
@@ -28,14 +38,15 @@ func NewClient(address string, pattern string, headers http.Header) (*Client, er
 	}
 
 	log.Print("client: Preparing handshake")
-	if err = clientHandshake(conn, address, pattern, headers); err != nil {
+	br := bufio.NewReader(conn)
+	if err = clientHandshake(conn, br, address, pattern, headers); err != nil {
 		return nil, err
 	}
 
-	return &Client{conn: conn}, nil
+	return &Client{conn: conn, br: br}, nil
 }
 
-func clientHandshake(conn net.Conn, address string, pattern string, headers http.Header) error {
+func clientHandshake(conn net.Conn, br *bufio.Reader, address string, pattern string, headers http.Header) error {
 	var buf []byte
 
 	buf = append(buf, fmt.Sprintf("GET %s HTTP/1.1\r\nUpgrade: WebSocket\r\nConnection: Upgrade\r\nContent-Length: 8\r\n", pattern)...)
@@ -65,7 +76,7 @@ func clientHandshake(conn net.Conn, address string, pattern string, headers http
 
 	var field []byte
 	for {
-		b, err := readByte(conn)
+		b, err := br.ReadByte()
 		if err != nil {
 			return fmt.Errorf("client: Can't read handshake response")
 		}
@@ -98,7 +109,7 @@ Fields:
 		var value []byte
 
 		for {
-			b, err := readByte(conn)
+			b, err := br.ReadByte()
 			if err != nil {
 				return fmt.Errorf("client: Error reading handshake headers")
 			}
@@ -130,7 +141,7 @@ Fields:
 
 		count := 0
 		for {
-			b, err := readByte(conn)
+			b, err := br.ReadByte()
 			if err != nil {
 				return fmt.Errorf("client: Error reading handshake headers")
 			}
@@ -152,14 +163,14 @@ Fields:
 			}
 		}
 
-		if b, err := readByte(conn); err != nil || b != 0x0a {
+		if b, err := br.ReadByte(); err != nil || b != 0x0a {
 			return fmt.Errorf("client: Error reading handshake headers")
 		}
 
 		fields[string(name)] = string(value)
 	}
 
-	if b, err := readByte(conn); err != nil || b != 0x0a {
+	if b, err := br.ReadByte(); err != nil || b != 0x0a {
 		return fmt.Errorf("client: Error reading handshake headers")
 	}
 
@@ -209,9 +220,9 @@ Fields:
 	binary.Write(challenge, binary.BigEndian, key3)
 	expected := md5.Sum(challenge.Bytes())
 
-	reply, err := readBytes(conn, 16)
+	reply, err := readBytes(br, 16)
 	if err != nil {
-		return fmt.Errorf("client: Could not read challenge")
+		return fmt.Errorf("client: Could not read challenge: %w", err)
 	}
 
 	if !bytes.Equal(expected[:], reply[:]) {
@@ -241,7 +252,7 @@ func websocketKey() (string, uint32) {
 			char = rand.IntN(69 /* nice */) + 58
 		}
 
-		key = key[:position] + string(char) + key[position:]
+		key = key[:position] + string(rune(char)) + key[position:]
 	}
 
 	for i := 0; i < spaces; i++ {
@@ -264,45 +275,58 @@ func (c *Client) Send(message []byte) error {
 		return fmt.Errorf("client: Message is not valid UTF-8")
 	}
 
-	if err := writeByte(c.conn, 0x00); err != nil {
-		return fmt.Errorf("client: Failed to write message type")
-	}
-
-	if err := writeBytes(c.conn, message); err != nil {
-		return fmt.Errorf("client: Failed to write message")
-	}
-
-	if err := writeByte(c.conn, 0xFF); err != nil {
-		return fmt.Errorf("client: Failed to write message terminator")
+	// The frame goes out in a single write, so it is never left half-written
+	// when the write times out.
+	frame := make([]byte, 0, len(message)+2)
+	frame = append(frame, 0x00)
+	frame = append(frame, message...)
+	frame = append(frame, 0xFF)
+	if err := writeBytes(c.conn, frame); err != nil {
+		return fmt.Errorf("client: Failed to write message: %w", err)
 	}
 
 	return nil
 }
 
 func (c *Client) Read() (string, error) {
-	frameType, err := readByte(c.conn)
+	message, err := c.readMessage()
+	if err != nil && c.reading {
+		// The rest of the message can't be told apart from the next one.
+		c.conn.Close()
+	}
+	return message, err
+}
+
+func (c *Client) readMessage() (string, error) {
+	frameType, err := c.br.ReadByte()
 	if err != nil {
-		return "", fmt.Errorf("client: Failed to read message type")
+		return "", fmt.Errorf("client: Failed to read message type: %w", err)
 	}
+	c.reading = true
 
 	var data string
 	isError := false
 	if frameType&0x80 == 0x80 {
 		length := 0
 		for {
-			b, err := readByte(c.conn)
+			b, err := c.br.ReadByte()
 			if err != nil {
-				return "", fmt.Errorf("client: Failed to read length")
+				return "", fmt.Errorf("client: Failed to read length: %w", unexpectedEOF(err))
 			}
 
+			// Lengths that would overflow are rejected rather than wrapped.
+			if length > (math.MaxInt-0x7F)/128 {
+				return "", fmt.Errorf("client: Invalid message length")
+			}
 			bV := int(b & 0x7F)
 			length = length*128 + bV
 			if b&0x80 == 0x80 {
 				continue
 			}
 
-			if _, err := readBytes(c.conn, length); err != nil {
-				return "", fmt.Errorf("client: Failed to read message")
+			// The payload of binary frames is skipped, not buffered.
+			if _, err := io.CopyN(io.Discard, c.br, int64(length)); err != nil {
+				return "", fmt.Errorf("client: Failed to read message: %w", unexpectedEOF(err))
 			}
 			break
 		}
@@ -317,14 +341,11 @@ func (c *Client) Read() (string, error) {
 			isError = true
 		}
 	} else if frameType&0x80 == 0x00 {
-		var rawData []byte
-		for b, err := readByte(c.conn); b != 0xFF; b, err = readByte(c.conn) {
-			if err != nil {
-				return "", fmt.Errorf("client: Failed to read message")
-			}
-
-			rawData = append(rawData, b)
+		rawData, err := c.br.ReadBytes(0xFF)
+		if err != nil {
+			return "", fmt.Errorf("client: Failed to read message: %w", unexpectedEOF(err))
 		}
+		rawData = rawData[:len(rawData)-1]
 
 		if !utf8.Valid(rawData) {
 			isError = true
@@ -337,6 +358,7 @@ func (c *Client) Read() (string, error) {
 		}
 	}
 
+	c.reading = false
 	if isError {
 		return "", fmt.Errorf("client: Invalid message")
 	}
@@ -358,24 +380,32 @@ func (c *Client) Close() error {
 	return nil
 }
 
-func readBytes(conn net.Conn, n int) ([]byte, error) {
+// readBytes reads exactly n bytes. Input that ends before them is reported
+// as io.ErrUnexpectedEOF.
+func readBytes(r io.Reader, n int) ([]byte, error) {
 	buf := make([]byte, n)
-	if _, err := conn.Read(buf); err != nil && err != io.EOF {
-		return nil, err
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, unexpectedEOF(err)
 	}
 	return buf, nil
 }
 
-func readByte(conn net.Conn) (byte, error) {
-	if buf, err := readBytes(conn, 1); err != nil {
-		return 0, err
-	} else {
-		return buf[0], nil
+// unexpectedEOF turns the end of input in the middle of a message into
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
 	}
+	return err
 }
 
 func writeBytes(conn net.Conn, b []byte) error {
-	if _, err := conn.Write(b); err != nil {
+	if n, err := conn.Write(b); err != nil {
+		// Nothing was sent, the connection can still be used.
+		if n == 0 && isTimeout(err) {
+			return err
+		}
+
 		conn.Close()
 		log.Printf("client: Failed to write bytes (%x): %v", b, err)
 		return err
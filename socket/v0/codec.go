@@ -0,0 +1,54 @@
+package v0
+
+import (
+	"fmt"
+
+	"github.com/Walter-Sparrow/go-socket/socket/codec"
+)
+
+// ReadJSON reads the next message and decodes it as JSON into v.
+func (c *Connection) ReadJSON(v any) error {
+	return readValue(c, codec.JSON, v)
+}
+
+// WriteJSON sends v encoded as JSON.
+func (c *Connection) WriteJSON(v any) error {
+	return writeValue(c, codec.JSON, v)
+}
+
+// ReadMessage reads the next message and decodes it with enc. A message that
+// doesn't decode is reported as a *codec.DecodeError and leaves the
+// connection usable.
+func ReadMessage[T any](c *Connection, enc codec.Codec) (T, error) {
+	var v T
+	err := readValue(c, enc, &v)
+	return v, err
+}
+
+// WriteMessage sends v encoded with enc. The protocol only carries text, so
+// enc must not be a binary codec.
+func WriteMessage[T any](c *Connection, enc codec.Codec, v T) error {
+	return writeValue(c, enc, v)
+}
+
+func readValue(c *Connection, enc codec.Codec, v any) error {
+	message, err := c.Read()
+	if err != nil {
+		return err
+	}
+	if err := enc.Unmarshal(message, v); err != nil {
+		return &codec.DecodeError{Message: message, Err: err}
+	}
+	return nil
+}
+
+func writeValue(c *Connection, enc codec.Codec, v any) error {
+	if enc.Binary() {
+		return fmt.Errorf("conn: Binary codecs are not supported")
+	}
+	message, err := enc.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Write(TextMessage, message)
+}
@@ -0,0 +1,44 @@
+package v0
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Walter-Sparrow/go-socket/socket/codec"
+)
+
+type codecMessage struct {
+	ID   int
+	Text string
+}
+
+func TestCodecMessages(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	writer, reader := NewConnection(a), NewConnection(b)
+	go func() {
+		writer.WriteJSON(codecMessage{1, "json"})
+		writer.Write(TextMessage, []byte("{not json"))
+		WriteMessage(writer, codec.JSON, codecMessage{2, "after"})
+	}()
+
+	var m codecMessage
+	if err := reader.ReadJSON(&m); err != nil || m != (codecMessage{1, "json"}) {
+		t.Errorf("ReadJSON: got %+v and %v", m, err)
+	}
+
+	_, err := ReadMessage[codecMessage](reader, codec.JSON)
+	var decodeErr *codec.DecodeError
+	if !errors.As(err, &decodeErr) || string(decodeErr.Message) != "{not json" {
+		t.Errorf("got %v, want a decode error for the invalid message", err)
+	}
+	if m, err := ReadMessage[codecMessage](reader, codec.JSON); err != nil || m != (codecMessage{2, "after"}) {
+		t.Errorf("read after a decode error: got %+v and %v", m, err)
+	}
+
+	if err := WriteMessage(writer, codec.Gob, 1); err == nil {
+		t.Error("wrote a binary codec message")
+	}
+}
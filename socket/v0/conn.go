@@ -1,10 +1,13 @@
 package v0
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 	"unicode/utf8"
 )
 
@@ -17,11 +20,22 @@ const (
 
 type Connection struct {
 	conn    net.Conn
+	br      *bufio.Reader
 	closing bool
+	// reading is set while a message is partly read.
+	reading bool
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
 }
 
 func NewConnection(conn net.Conn) *Connection {
-	return &Connection{conn: conn}
+	return newConnection(conn, bufio.NewReader(conn))
+}
+
+func newConnection(conn net.Conn, br *bufio.Reader) *Connection {
+	return &Connection{conn: conn, br: br}
 }
 
 // Close closes the underlying connection without a close frame
@@ -42,28 +56,22 @@ func (c *Connection) writeTextMessage(message []byte) error {
 		return fmt.Errorf("conn: Message is not valid UTF-8")
 	}
 
-	if err := c.writeByte(0x00); err != nil {
-		return fmt.Errorf("conn: Failed to write message type")
-	}
-
-	if err := c.writeBytes(message); err != nil {
-		return fmt.Errorf("conn: Failed to write message")
-	}
-
-	if err := c.writeByte(0xFF); err != nil {
-		return fmt.Errorf("conn: Failed to write message terminator")
+	// The frame goes out in a single write, so it is never left half-written
+	// when the write times out.
+	frame := make([]byte, 0, len(message)+2)
+	frame = append(frame, 0x00)
+	frame = append(frame, message...)
+	frame = append(frame, 0xFF)
+	if err := c.writeBytes(frame); err != nil {
+		return fmt.Errorf("conn: Failed to write message: %w", err)
 	}
 
 	return nil
 }
 
 func (c *Connection) writeCloseMessage() error {
-	if err := c.writeByte(0xFF); err != nil {
-		return fmt.Errorf("conn: Failed to write close message")
-	}
-
-	if err := c.writeByte(0x00); err != nil {
-		return fmt.Errorf("conn: Failed to write close code")
+	if err := c.writeBytes([]byte{0xFF, 0x00}); err != nil {
+		return fmt.Errorf("conn: Failed to write close message: %w", err)
 	}
 
 	c.closing = true
@@ -74,8 +82,9 @@ func (c *Connection) writeCloseMessage() error {
 func (c *Connection) Read() ([]byte, error) {
 	typeByte, err := c.readByte()
 	if err != nil {
-		return nil, fmt.Errorf("conn: Failed to read message type")
+		return nil, fmt.Errorf("conn: Failed to read message type: %w", err)
 	}
+	c.reading = true
 
 	if typeByte>>7 == 0 {
 		if typeByte != 0x00 {
@@ -83,7 +92,13 @@ func (c *Connection) Read() ([]byte, error) {
 			return nil, fmt.Errorf("conn: Invalid message type 0x%02x", typeByte)
 		}
 
-		return c.readTextMessage()
+		message, err := c.readTextMessage()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.reading = false
+		return message, nil
 	} else {
 		if typeByte != 0xFF {
 			c.Close()
@@ -92,7 +107,8 @@ func (c *Connection) Read() ([]byte, error) {
 
 		b, err := c.readByte()
 		if err != nil {
-			return nil, fmt.Errorf("conn: Failed to read close code")
+			c.Close()
+			return nil, fmt.Errorf("conn: Failed to read close code: %w", unexpectedEOF(err))
 		}
 
 		if b != 0x00 {
@@ -109,38 +125,38 @@ func (c *Connection) Read() ([]byte, error) {
 }
 
 func (c *Connection) readTextMessage() ([]byte, error) {
-	rawData := new([]byte)
-
-	for {
-		b, err := c.readByte()
-		if err != nil {
-			return nil, fmt.Errorf("conn: Failed to read message")
-		}
-
-		if b == 0xFF {
-			break
-		}
-
-		*rawData = append(*rawData, b)
+	message, err := c.br.ReadBytes(0xFF)
+	if err != nil {
+		return nil, fmt.Errorf("conn: Failed to read message: %w", unexpectedEOF(err))
 	}
 
-	return *rawData, nil
+	return message[:len(message)-1], nil
 }
 
 func (c *Connection) readByte() (byte, error) {
-	buf := make([]byte, 1)
-
-	if _, err := c.conn.Read(buf); err != nil && err != io.EOF {
-		c.Close()
-		log.Printf("conn: Failed to read byte: %v", err)
+	b, err := c.br.ReadByte()
+	if err != nil {
+		// A timeout leaves it to the caller whether the connection is
+		// still usable.
+		if !isTimeout(err) {
+			c.Close()
+			if err != io.EOF {
+				log.Printf("conn: Failed to read byte: %v", err)
+			}
+		}
 		return 0, err
 	}
 
-	return buf[0], nil
+	return b, nil
 }
 
 func (c *Connection) writeBytes(b []byte) error {
-	if _, err := c.conn.Write(b); err != nil {
+	if n, err := c.conn.Write(b); err != nil {
+		// Nothing was sent, the connection can still be used.
+		if n == 0 && isTimeout(err) {
+			return err
+		}
+
 		c.Close()
 		log.Printf("conn: Failed to write bytes: %v", err)
 		return err
@@ -0,0 +1,151 @@
+package v0
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Walter-Sparrow/go-socket/socket/internal/chaos"
+)
+
+var chaosModes = []struct {
+	name string
+	wrap func(net.Conn) net.Conn
+}{
+	{"one-byte", func(c net.Conn) net.Conn { return chaos.OneByte(c) }},
+	{"random", func(c net.Conn) net.Conn { return chaos.Random(c, 1, 37) }},
+}
+
+var chaosMessages = []string{
+	"",
+	"hello",
+	"Hello-µ@ßöäüàá-UTF-8!!",
+	strings.Repeat("κόσμε", 20000),
+}
+
+func TestReadChaos(t *testing.T) {
+	for _, mode := range chaosModes {
+		t.Run(mode.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			go func() {
+				w := NewConnection(a)
+				for _, message := range chaosMessages {
+					w.Write(TextMessage, []byte(message))
+				}
+				w.Write(CloseMessage, nil)
+				io.Copy(io.Discard, a)
+			}()
+
+			conn := mode.wrap(b)
+			c := newConnection(conn, bufio.NewReader(conn))
+			for _, want := range chaosMessages {
+				message, err := c.Read()
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				if string(message) != want {
+					t.Fatalf("got %d bytes, want %d", len(message), len(want))
+				}
+			}
+			if _, err := c.Read(); err == nil || err.Error() != "conn: Connection closed" {
+				t.Fatalf("read after close message: %v", err)
+			}
+		})
+	}
+}
+
+func TestClientReadChaos(t *testing.T) {
+	for _, mode := range chaosModes {
+		t.Run(mode.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			go func() {
+				w := NewConnection(a)
+				w.Write(TextMessage, []byte(chaosMessages[3]))
+				// A binary frame of 200 bytes, which clients skip.
+				a.Write(append([]byte{0x80, 0x81, 0x48}, make([]byte, 200)...))
+				w.Write(TextMessage, []byte(chaosMessages[2]))
+				io.Copy(io.Discard, a)
+			}()
+
+			conn := mode.wrap(b)
+			c := &Client{conn: conn, br: bufio.NewReader(conn)}
+			if message, err := c.Read(); err != nil || message != chaosMessages[3] {
+				t.Fatalf("got %d bytes and %v, want %d bytes", len(message), err, len(chaosMessages[3]))
+			}
+			if _, err := c.Read(); err == nil {
+				t.Fatal("binary frame was read as a message")
+			}
+			if message, err := c.Read(); err != nil || message != chaosMessages[2] {
+				t.Fatalf("got %q and %v, want %q", message, err, chaosMessages[2])
+			}
+		})
+	}
+}
+
+func TestHandshakeChaos(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		c.Write(TextMessage, []byte("hello"))
+		c.Read()
+	}))
+	defer srv.Close()
+
+	for _, mode := range chaosModes {
+		t.Run(mode.name, func(t *testing.T) {
+			address := strings.TrimPrefix(srv.URL, "http://")
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn = mode.wrap(conn)
+			defer conn.Close()
+
+			br := bufio.NewReader(conn)
+			headers := http.Header{"Host": {address}, "Origin": {"http://example.com"}}
+			if err := clientHandshake(conn, br, address, "/ws", headers); err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+
+			c := &Client{conn: conn, br: br}
+			if message, err := c.Read(); err != nil || message != "hello" {
+				t.Fatalf("got %q and %v, want hello", message, err)
+			}
+			c.Close()
+		})
+	}
+}
+
+func TestReadUnexpectedEOF(t *testing.T) {
+	for _, input := range []string{"\x00hel", "\xff", "\x80\x85"} {
+		a, b := net.Pipe()
+		go func() {
+			a.Write([]byte(input))
+			a.Close()
+		}()
+
+		c := &Client{conn: b, br: bufio.NewReader(b)}
+		if _, err := c.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("client read of %q: got %v, want %v", input, err, io.ErrUnexpectedEOF)
+		}
+	}
+
+	a, b := net.Pipe()
+	go func() {
+		a.Write([]byte("\x00hel"))
+		a.Close()
+	}()
+	if _, err := NewConnection(b).Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("read: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,147 @@
+package v0
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, setting it aborts blocked I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// SetReadDeadline sets the deadline for reading from the peer. A read that
+// times out while waiting for a message leaves the connection usable, a
+// timeout in the middle of one closes it.
+func (c *Connection) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writing messages. A write that
+// times out before any of its message went out leaves the connection usable,
+// a message that was cut off closes the connection.
+func (c *Connection) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
+
+// ReadContext is Read that gives up when ctx is done. Cancelling while
+// waiting for a message leaves the connection usable, cancelling in the
+// middle of one closes it.
+func (c *Connection) ReadContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stop := interruptOnDone(ctx, &c.deadlineMu, c.conn.SetReadDeadline, &c.readDeadline)
+	message, err := c.Read()
+	if stop() && err != nil {
+		if c.reading {
+			return nil, fmt.Errorf("conn: Read aborted in the middle of a message: %w", ctx.Err())
+		}
+		return nil, ctx.Err()
+	}
+	return message, err
+}
+
+// WriteContext is Write that gives up when ctx is done. A message is written
+// at once, so cancelling before any of it went out leaves the connection
+// usable and cancelling in the middle of it closes the connection.
+func (c *Connection) WriteContext(ctx context.Context, messageType MessageType, message []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stop := interruptOnDone(ctx, &c.deadlineMu, c.conn.SetWriteDeadline, &c.writeDeadline)
+	err := c.Write(messageType, message)
+	if stop() && err != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// SetReadDeadline sets the deadline for reading from the server, see
+// Connection.SetReadDeadline.
+func (c *Client) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for sending messages, see
+// Connection.SetWriteDeadline.
+func (c *Client) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
+
+// ReadContext is Read that gives up when ctx is done. Cancelling while
+// waiting for a message leaves the connection usable, cancelling in the
+// middle of one closes it.
+func (c *Client) ReadContext(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	stop := interruptOnDone(ctx, &c.deadlineMu, c.conn.SetReadDeadline, &c.readDeadline)
+	message, err := c.Read()
+	if stop() && err != nil {
+		if c.reading {
+			return "", fmt.Errorf("client: Read aborted in the middle of a message: %w", ctx.Err())
+		}
+		return "", ctx.Err()
+	}
+	return message, err
+}
+
+// SendContext is Send that gives up when ctx is done, see WriteContext.
+func (c *Client) SendContext(ctx context.Context, message []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stop := interruptOnDone(ctx, &c.deadlineMu, c.conn.SetWriteDeadline, &c.writeDeadline)
+	err := c.Send(message)
+	if stop() && err != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// interruptOnDone moves the deadline set by setDeadline into the past once
+// ctx is done. The returned function stops watching ctx; if ctx interrupted
+// the I/O, it restores the deadline and reports true. mu guards deadline.
+func interruptOnDone(ctx context.Context, mu *sync.Mutex, setDeadline func(time.Time) error, deadline *time.Time) func() bool {
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		setDeadline(aLongTimeAgo)
+		close(fired)
+	})
+
+	return func() bool {
+		if stop() {
+			return false
+		}
+		<-fired
+		mu.Lock()
+		defer mu.Unlock()
+		setDeadline(*deadline)
+		return true
+	}
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,201 @@
+package v0
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe returns a server connection, a client and the raw other end of each.
+func pipe(t *testing.T) (c *Connection, cPeer net.Conn, client *Client, clientPeer net.Conn) {
+	a, b := net.Pipe()
+	d, e := net.Pipe()
+	c = newConnection(a, bufio.NewReader(a))
+	client = &Client{conn: d, br: bufio.NewReader(d)}
+	t.Cleanup(func() {
+		for _, conn := range []net.Conn{a, b, d, e} {
+			conn.Close()
+		}
+	})
+	return c, b, client, e
+}
+
+// cancelSoon returns a context that is cancelled once the I/O under test had
+// time to block.
+func cancelSoon(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	return ctx
+}
+
+// isClosed reports whether the end of peer was closed.
+func isClosed(peer net.Conn) bool {
+	_, err := peer.Write([]byte{0x00})
+	return errors.Is(err, io.ErrClosedPipe)
+}
+
+func TestReadContext(t *testing.T) {
+	c, cPeer, client, clientPeer := pipe(t)
+
+	// Cancelling before a message leaves the connections usable.
+	if _, err := c.ReadContext(cancelSoon(t)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if _, err := client.ReadContext(cancelSoon(t)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("client: got %v, want %v", err, context.Canceled)
+	}
+	go cPeer.Write([]byte("\x00hello\xff"))
+	if message, err := c.Read(); err != nil || string(message) != "hello" {
+		t.Fatalf("got %q and %v after cancelling", message, err)
+	}
+	go clientPeer.Write([]byte("\x00hello\xff"))
+	if message, err := client.Read(); err != nil || message != "hello" {
+		t.Fatalf("client: got %q and %v after cancelling", message, err)
+	}
+
+	// Cancelling in the middle of a message closes them.
+	go cPeer.Write([]byte("\x00hel"))
+	if _, err := c.ReadContext(cancelSoon(t)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if !isClosed(cPeer) {
+		t.Error("connection was not closed")
+	}
+	go clientPeer.Write([]byte("\x00hel"))
+	if _, err := client.ReadContext(cancelSoon(t)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("client: got %v, want %v", err, context.Canceled)
+	}
+	if !isClosed(clientPeer) {
+		t.Error("client was not closed")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	c, cPeer, client, clientPeer := pipe(t)
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Read(); !isTimeout(err) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	c.SetReadDeadline(time.Time{})
+	go cPeer.Write([]byte("\x00hello\xff"))
+	if message, err := c.Read(); err != nil || string(message) != "hello" {
+		t.Fatalf("got %q and %v after the timeout", message, err)
+	}
+
+	// A client that timed out in the middle of a message is closed.
+	go clientPeer.Write([]byte("\x00hel"))
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := client.Read(); !isTimeout(err) {
+		t.Fatalf("client: got %v, want a timeout", err)
+	}
+	if !isClosed(clientPeer) {
+		t.Error("client was not closed")
+	}
+}
+
+// TestSetDeadlineDuringRead sets the deadlines while ReadContext calls are
+// being cancelled, for the race detector.
+func TestSetDeadlineDuringRead(t *testing.T) {
+	c, _, client, _ := pipe(t)
+	for i := 0; i < 50; i++ {
+		for _, conn := range []interface {
+			SetReadDeadline(time.Time) error
+			SetWriteDeadline(time.Time) error
+		}{c, client} {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(time.Millisecond, cancel)
+			setters := make(chan struct{})
+			go func() {
+				defer close(setters)
+				// A deadline set while the read is being interrupted may
+				// resume it, so it is short.
+				for n := 0; n < 100; {
+					deadline := time.Now().Add(5 * time.Millisecond)
+					conn.SetReadDeadline(deadline)
+					conn.SetWriteDeadline(deadline)
+					if ctx.Err() != nil {
+						n++
+					}
+				}
+			}()
+
+			var err error
+			if conn == c {
+				_, err = c.ReadContext(ctx)
+			} else {
+				_, err = client.ReadContext(ctx)
+			}
+			if err == nil {
+				t.Fatal("read returned no error")
+			}
+			<-setters
+		}
+	}
+}
+
+// TestWriteContext checks that cancelled writes never leave part of a message
+// on the wire: either nothing went out and the connection is usable, or it
+// is closed.
+func TestWriteContext(t *testing.T) {
+	c, cPeer, client, clientPeer := pipe(t)
+
+	if err := c.WriteContext(cancelSoon(t), TextMessage, []byte("first")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if err := client.SendContext(cancelSoon(t), []byte("first")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("client: got %v, want %v", err, context.Canceled)
+	}
+	go c.Write(TextMessage, []byte("second"))
+	if message, err := NewConnection(cPeer).Read(); err != nil || string(message) != "second" {
+		t.Fatalf("got %q and %v after cancelling", message, err)
+	}
+	go client.Send([]byte("second"))
+	if message, err := NewConnection(clientPeer).Read(); err != nil || string(message) != "second" {
+		t.Fatalf("client: got %q and %v after cancelling", message, err)
+	}
+
+	go io.ReadFull(cPeer, make([]byte, 3))
+	if err := c.WriteContext(cancelSoon(t), TextMessage, make([]byte, 1<<16)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if err := c.Write(TextMessage, []byte("next")); err == nil {
+		t.Error("wrote after a message was cut off")
+	}
+	go io.ReadFull(clientPeer, make([]byte, 3))
+	if err := client.SendContext(cancelSoon(t), make([]byte, 1<<16)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("client: got %v, want %v", err, context.Canceled)
+	}
+	if err := client.Send([]byte("next")); err == nil {
+		t.Error("client sent after a message was cut off")
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	c, cPeer, client, clientPeer := pipe(t)
+
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := c.Write(TextMessage, []byte("first")); !isTimeout(err) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := client.Send([]byte("first")); !isTimeout(err) {
+		t.Fatalf("client: got %v, want a timeout", err)
+	}
+
+	c.SetWriteDeadline(time.Time{})
+	go c.Write(TextMessage, []byte("second"))
+	if message, err := NewConnection(cPeer).Read(); err != nil || string(message) != "second" {
+		t.Fatalf("got %q and %v after the timeout", message, err)
+	}
+	client.SetWriteDeadline(time.Time{})
+	go client.Send([]byte("second"))
+	if message, err := NewConnection(clientPeer).Read(); err != nil || string(message) != "second" {
+		t.Fatalf("client: got %q and %v after the timeout", message, err)
+	}
+}
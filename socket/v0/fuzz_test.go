@@ -0,0 +1,119 @@
+package v0
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// draftExamples are the frames of the hixie-76 draft.
+var draftExamples = []string{
+	"\x00Hello\xff",
+	"\x00\xff",
+	"\x00Hello-µ@ßöäüàá-UTF-8!!\xff\x00κόσμε\xff",
+	// The closing handshake
+	"\xff\x00",
+	// Frames with a length, which clients skip
+	"\x80\x05Hello\x00Hello\xff",
+	"\x81\x00" + string(make([]byte, 128)),
+}
+
+// fuzzConn reads the fuzz input and keeps what is written.
+type fuzzConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *fuzzConn) Write(p []byte) (int, error)        { return c.w.Write(p) }
+func (c *fuzzConn) Close() error                       { return nil }
+func (c *fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func FuzzConnectionRead(f *testing.F) {
+	for _, example := range draftExamples {
+		f.Add([]byte(example))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := &fuzzConn{r: bytes.NewReader(data)}
+		c := newConnection(conn, bufio.NewReader(conn))
+		for {
+			message, err := c.Read()
+			if err != nil {
+				return
+			}
+			// Every message is framed by 0x00 and 0xFF in the input.
+			frame := append(append([]byte{0x00}, message...), 0xFF)
+			if bytes.IndexByte(message, 0xFF) >= 0 || !bytes.Contains(data, frame) {
+				t.Fatalf("message %q is not in the input", message)
+			}
+		}
+	})
+}
+
+func FuzzClientRead(f *testing.F) {
+	for _, example := range draftExamples {
+		f.Add([]byte(example))
+	}
+	// A length that overflows
+	f.Add([]byte("\x80\xff\xff\xff\xff\xff\xff\xff\xff\xff\x7f\x00Hello\xff"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := &fuzzConn{r: bytes.NewReader(data)}
+		c := &Client{conn: conn, br: bufio.NewReader(conn)}
+		for {
+			message, err := c.Read()
+			if err != nil {
+				if err.Error() == "client: Invalid message" {
+					continue
+				}
+				return
+			}
+			if !utf8.ValidString(message) {
+				t.Fatalf("message %q is not valid UTF-8", message)
+			}
+			if !bytes.Contains(data, []byte("\x00"+message+"\xff")) {
+				t.Fatalf("message %q is not in the input", message)
+			}
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("Hello")
+	f.Add("")
+	f.Add("Hello-µ@ßöäüàá-UTF-8!!")
+
+	f.Fuzz(func(t *testing.T, message string) {
+		if !utf8.ValidString(message) {
+			return
+		}
+
+		// From client to server
+		out := &fuzzConn{}
+		if err := (&Client{conn: out}).Send([]byte(message)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		in := &fuzzConn{r: &out.w}
+		got, err := newConnection(in, bufio.NewReader(in)).Read()
+		if err != nil || string(got) != message {
+			t.Fatalf("server read %q and %v, want %q", got, err, message)
+		}
+
+		// From server to client
+		out = &fuzzConn{}
+		if err := newConnection(out, nil).Write(TextMessage, []byte(message)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		in = &fuzzConn{r: &out.w}
+		if got, err := (&Client{conn: in, br: bufio.NewReader(in)}).Read(); err != nil || got != message {
+			t.Fatalf("client read %q and %v, want %q", got, err, message)
+		}
+	})
+}
@@ -6,7 +6,6 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"strings"
@@ -23,11 +22,10 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (*Connection, error) {
 	key1 := r.Header.Get("Sec-WebSocket-Key1")
 	key2 := r.Header.Get("Sec-WebSocket-Key2")
 
-	challengeClient := make([]byte, 8)
-	n, err := r.Body.Read(challengeClient)
-	if (err != nil && err != io.EOF) || n != 8 {
+	challengeClient, err := readBytes(r.Body, 8)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("server: Could not read challenge")
+		return nil, fmt.Errorf("server: Could not read challenge: %w", err)
 	}
 
 	challenge, err := computeChallenge(key1, key2, challengeClient)
@@ -51,7 +49,8 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (*Connection, error) {
 	location := conn.LocalAddr().String() + r.URL.Path
 	serverHandshake(buf, r.Header, location, challenge)
 
-	return NewConnection(conn), nil
+	// buf.Reader may already hold what the client sent after the handshake.
+	return newConnection(conn, buf.Reader), nil
 }
 
 func validateHeaders(headers http.Header) bool {
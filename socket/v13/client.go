@@ -0,0 +1,196 @@
+package v13
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+type DialOptions struct {
+	// Header is sent with the handshake request, e.g. Origin or Authorization.
+	Header http.Header
+	// Subprotocols are offered to the server in order of preference.
+	Subprotocols []string
+	// TLSConfig is used for wss:// URLs.
+	TLSConfig *tls.Config
+	// EnableCompression offers the permessage-deflate extension.
+	EnableCompression bool
+}
+
+func Dial(ctx context.Context, urlStr string, opts *DialOptions) (*Connection, error) {
+	if opts == nil {
+		opts = &DialOptions{}
+	}
+
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("client: Invalid URL: %v", err)
+	}
+
+	var secure bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, fmt.Errorf("client: Unsupported URL scheme %q", u.Scheme)
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		if secure {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	if secure {
+		tlsConfig := opts.TLSConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+
+	br := bufio.NewReaderSize(conn, defaultBufferSize)
+	subprotocol, compression, err := clientHandshake(conn, br, u, opts)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := newConnection(conn, br, defaultBufferSize, false)
+	c.subprotocol = subprotocol
+	c.setCompression(compression)
+	return c, nil
+}
+
+func clientHandshake(conn net.Conn, br *bufio.Reader, u *url.URL, opts *DialOptions) (string, *compressionParams, error) {
+	key, err := challengeKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	bw := bufio.NewWriter(conn)
+	bw.WriteString(fmt.Sprintf("GET %s HTTP/1.1\r\n", u.RequestURI()))
+	bw.WriteString(fmt.Sprintf("Host: %s\r\n", u.Host))
+	bw.WriteString("Upgrade: websocket\r\n")
+	bw.WriteString("Connection: Upgrade\r\n")
+	bw.WriteString(fmt.Sprintf("Sec-WebSocket-Key: %s\r\n", key))
+	bw.WriteString("Sec-WebSocket-Version: 13\r\n")
+	if len(opts.Subprotocols) > 0 {
+		bw.WriteString(fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", strings.Join(opts.Subprotocols, ", ")))
+	}
+	if opts.EnableCompression {
+		bw.WriteString(fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n", deflateExtension))
+	}
+	for name, values := range opts.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Host", "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version",
+			"Sec-Websocket-Protocol", "Sec-Websocket-Extensions":
+			continue
+		}
+
+		for _, value := range values {
+			bw.WriteString(fmt.Sprintf("%s: %s\r\n", name, value))
+		}
+	}
+	bw.WriteString("\r\n")
+	if err := bw.Flush(); err != nil {
+		return "", nil, fmt.Errorf("client: Failed to write handshake: %v", err)
+	}
+
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet, URL: u})
+	if err != nil {
+		return "", nil, fmt.Errorf("client: Can't read handshake response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return "", nil, fmt.Errorf("client: Wrong server response code: %s", resp.Status)
+	}
+
+	if strings.ToLower(resp.Header.Get("Upgrade")) != "websocket" {
+		return "", nil, fmt.Errorf("client: Wrong Upgrade header in handshake response")
+	}
+
+	if !headerContainsToken(resp.Header, "Connection", "upgrade") {
+		return "", nil, fmt.Errorf("client: Wrong Connection header in handshake response")
+	}
+
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != computeAcceptKey(key) {
+		return "", nil, fmt.Errorf("client: Wrong Sec-WebSocket-Accept in handshake response: %s", accept)
+	}
+
+	subprotocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if subprotocol != "" && !slices.Contains(opts.Subprotocols, subprotocol) {
+		return "", nil, fmt.Errorf("client: Server selected subprotocol %q that was not offered", subprotocol)
+	}
+
+	if !opts.EnableCompression {
+		if extensions := resp.Header.Get("Sec-WebSocket-Extensions"); extensions != "" {
+			return "", nil, fmt.Errorf("client: Server selected extensions %q that were not offered", extensions)
+		}
+		return subprotocol, nil, nil
+	}
+
+	compression, err := acceptCompression(resp.Header)
+	if err != nil {
+		return "", nil, err
+	}
+	return subprotocol, compression, nil
+}
+
+func challengeKey() (string, error) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", fmt.Errorf("client: Could not generate key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key[:]), nil
+}
+
+// newMaskKey fills key with a fresh mask key.
+func newMaskKey(key *[4]byte) error {
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("conn: Could not generate mask key: %v", err)
+	}
+	return nil
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	return slices.ContainsFunc(headerTokens(header, name), func(t string) bool {
+		return strings.EqualFold(t, token)
+	})
+}
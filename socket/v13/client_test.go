@@ -0,0 +1,162 @@
+package v13
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// handshakeServer answers every handshake with the response respond writes,
+// then hands the raw connection to handler if it is not nil.
+func handshakeServer(t *testing.T, respond func(buf *bufio.ReadWriter, r *http.Request), handler func(br *bufio.Reader)) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		respond(buf, r)
+		buf.Flush()
+		if handler != nil {
+			handler(buf.Reader)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func switchingProtocols(buf *bufio.ReadWriter, r *http.Request, extra string) {
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n%s\r\n", computeAcceptKey(r.Header.Get("Sec-WebSocket-Key")), extra)
+}
+
+func TestDialRequest(t *testing.T) {
+	requests := make(chan *http.Request, 2)
+	url := handshakeServer(t, func(buf *bufio.ReadWriter, r *http.Request) {
+		requests <- r
+		switchingProtocols(buf, r, "")
+	}, nil)
+
+	opts := &DialOptions{
+		Subprotocols: []string{"v2", "v1"},
+		Header:       http.Header{"Origin": {"http://example.com"}, "Sec-Websocket-Key": {"forged"}},
+	}
+	var keys []string
+	for i := 0; i < 2; i++ {
+		dialTest(t, url+"/chat?room=1", opts)
+		r := <-requests
+		if r.URL.RequestURI() != "/chat?room=1" {
+			t.Errorf("got request URI %q", r.URL.RequestURI())
+		}
+		for name, want := range map[string]string{
+			"Upgrade":                "websocket",
+			"Connection":             "Upgrade",
+			"Sec-WebSocket-Version":  "13",
+			"Sec-WebSocket-Protocol": "v2, v1",
+			"Origin":                 "http://example.com",
+		} {
+			if got := r.Header.Get(name); got != want {
+				t.Errorf("%s: got %q, want %q", name, got, want)
+			}
+		}
+		key := r.Header.Values("Sec-WebSocket-Key")
+		if len(key) != 1 {
+			t.Fatalf("got keys %q", key)
+		}
+		if raw, err := base64.StdEncoding.DecodeString(key[0]); err != nil || len(raw) != 16 {
+			t.Errorf("key %q is not 16 bytes in base64", key[0])
+		}
+		keys = append(keys, key[0])
+	}
+	if keys[0] == keys[1] {
+		t.Error("the key was reused")
+	}
+}
+
+func TestDialResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response func(buf *bufio.ReadWriter, r *http.Request)
+	}{
+		{"not switching", func(buf *bufio.ReadWriter, r *http.Request) {
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+		}},
+		{"wrong accept key", func(buf *bufio.ReadWriter, r *http.Request) {
+			fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Accept: %s\r\n\r\n", computeAcceptKey("other"))
+		}},
+		{"no upgrade", func(buf *bufio.ReadWriter, r *http.Request) {
+			fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Accept: %s\r\n\r\n", computeAcceptKey(r.Header.Get("Sec-WebSocket-Key")))
+		}},
+		{"no connection upgrade", func(buf *bufio.ReadWriter, r *http.Request) {
+			fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: keep-alive\r\n"+
+				"Sec-WebSocket-Accept: %s\r\n\r\n", computeAcceptKey(r.Header.Get("Sec-WebSocket-Key")))
+		}},
+		{"subprotocol not offered", func(buf *bufio.ReadWriter, r *http.Request) {
+			switchingProtocols(buf, r, "Sec-WebSocket-Protocol: other\r\n")
+		}},
+	}
+	for _, tt := range tests {
+		url := handshakeServer(t, tt.response, nil)
+		c, err := Dial(context.Background(), url, &DialOptions{Subprotocols: []string{"chat"}})
+		if err == nil {
+			c.Close()
+			t.Errorf("%s: dial succeeded", tt.name)
+		}
+	}
+
+	if _, err := Dial(context.Background(), "http://example.com/", nil); err == nil {
+		t.Error("dial of an http:// URL succeeded")
+	}
+}
+
+// TestDialMasking checks that every client frame is masked with a new key.
+func TestDialMasking(t *testing.T) {
+	frames := make(chan *Frame, 2)
+	url := handshakeServer(t, func(buf *bufio.ReadWriter, r *http.Request) {
+		switchingProtocols(buf, r, "Sec-WebSocket-Protocol: chat\r\n")
+	}, func(br *bufio.Reader) {
+		for i := 0; i < 2; i++ {
+			frame, err := ReadFrame(br)
+			if err != nil {
+				t.Errorf("read: %v", err)
+				break
+			}
+			frames <- frame
+		}
+		close(frames)
+	})
+
+	c := dialTest(t, url, &DialOptions{Subprotocols: []string{"chat"}})
+	if c.Subprotocol() != "chat" {
+		t.Errorf("got subprotocol %q, want chat", c.Subprotocol())
+	}
+	message := []byte("hello")
+	c.Write(OpText, message)
+	c.Write(OpText, message)
+	if string(message) != "hello" {
+		t.Errorf("the message was masked in place: %q", message)
+	}
+
+	var keys [][4]byte
+	for frame := range frames {
+		if !frame.Mask {
+			t.Fatal("frame is not masked")
+		}
+		frame.MaskPayload()
+		if string(frame.Payload) != "hello" {
+			t.Errorf("got payload %q", frame.Payload)
+		}
+		keys = append(keys, frame.MaskKey)
+	}
+	if len(keys) != 2 || keys[0] == keys[1] {
+		t.Errorf("got mask keys %v, want two different ones", keys)
+	}
+}
@@ -0,0 +1,141 @@
+package v13
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultCloseTimeout = 5 * time.Second
+	maxControlPayload   = 125
+)
+
+// CloseError is returned by Read once the peer has closed the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("conn: Connection closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("conn: Connection closed with code %d: %s", e.Code, e.Reason)
+}
+
+// SetCloseTimeout sets how long CloseWithReason waits for the peer to answer
+// the close frame before dropping the connection. It is safe to call while
+// another goroutine closes the connection.
+func (c *Connection) SetCloseTimeout(d time.Duration) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.closeTimeout = d
+}
+
+// CloseWithReason performs the closing handshake: it sends a close frame,
+// waits for the peer's close frame and then closes the underlying connection.
+// If another goroutine is reading, the peer's close frame is left to it.
+func (c *Connection) CloseWithReason(code int, reason string) error {
+	if !isValidCloseCode(code) {
+		return fmt.Errorf("conn: Invalid close code %d", code)
+	}
+
+	if len(reason) > maxControlPayload-2 {
+		return fmt.Errorf("conn: Close reason is too long")
+	}
+
+	if !utf8.ValidString(reason) {
+		return fmt.Errorf("conn: Close reason is not valid UTF-8")
+	}
+
+	err := c.writeFrame(context.Background(), NewCloseFrame(uint16(code), reason))
+	if err == nil {
+		c.waitForClose()
+	}
+
+	if closeErr := c.Close(); err == nil && !errors.Is(closeErr, net.ErrClosed) {
+		err = closeErr
+	}
+	return err
+}
+
+// drop sends a close frame and closes the connection without waiting for the
+// peer. The peer is likely gone or stuck, so the close frame gets little time
+// to go out.
+func (c *Connection) drop(code uint16, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.writeFrame(ctx, NewCloseFrame(code, reason))
+	c.Close()
+}
+
+func (c *Connection) waitForClose() {
+	c.deadlineMu.Lock()
+	timeout := c.closeTimeout
+	c.deadlineMu.Unlock()
+
+	if !c.readMu.TryLock() {
+		select {
+		case <-c.closeReceived:
+		case <-time.After(timeout):
+		}
+		return
+	}
+	defer c.readMu.Unlock()
+
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	// Skip the rest of a frame the reader stopped in the middle of.
+	if _, err := c.br.Discard(int(c.readRemaining)); err != nil {
+		return
+	}
+	for {
+		frame, err := ReadFrame(c.br)
+		if err != nil || frame.Opcode == OpClose {
+			return
+		}
+	}
+}
+
+// parseClosePayload decodes the status code and reason of a received close
+// frame. An invalid payload is reported as the close frame the connection
+// must be failed with.
+func parseClosePayload(payload []byte) (closeErr *CloseError, failure *CloseError) {
+	if len(payload) == 0 {
+		return &CloseError{Code: CloseNoStatusReceived}, nil
+	}
+
+	if len(payload) == 1 {
+		return nil, &CloseError{Code: CloseProtocolError, Reason: "Close payload is too short"}
+	}
+
+	closeErr = &CloseError{
+		Code:   int(binary.BigEndian.Uint16(payload)),
+		Reason: string(payload[2:]),
+	}
+	if !isValidCloseCode(closeErr.Code) {
+		return nil, &CloseError{Code: CloseProtocolError, Reason: fmt.Sprintf("Invalid close code %d", closeErr.Code)}
+	}
+	if !utf8.ValidString(closeErr.Reason) {
+		return nil, &CloseError{Code: CloseInvalidFramePayload, Reason: "Close reason is not valid UTF-8"}
+	}
+	return closeErr, nil
+}
+
+// isValidCloseCode reports whether code may be sent in a close frame.
+// 1005, 1006 and 1015 are reserved for local use only (RFC 6455 7.4.1).
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= CloseNormalClosure && code <= CloseUnsupportedData:
+		return true
+	case code >= CloseInvalidFramePayload && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
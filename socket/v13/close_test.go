@@ -0,0 +1,145 @@
+package v13
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSetCloseTimeoutDuringClose sets the close timeout while the connection
+// is being closed, for the race detector.
+func TestSetCloseTimeoutDuringClose(t *testing.T) {
+	c, peer := rawClient(t)
+	go func() {
+		br := bufio.NewReader(peer)
+		ReadFrame(br)
+		peer.Write(maskedFrame(true, OpClose, closePayload(CloseNormalClosure, "")))
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.CloseWithReason(CloseNormalClosure, "")
+	}()
+	for i := 0; i < 100; i++ {
+		c.SetCloseTimeout(time.Second)
+	}
+	<-done
+}
+
+func TestCloseWithReason(t *testing.T) {
+	c, peer := rawClient(t)
+	p := pipePeer(peer)
+	closed := make(chan error, 1)
+	go func() { closed <- c.CloseWithReason(CloseGoingAway, "bye") }()
+
+	if err := p.expect(OpClose, closePayload(CloseGoingAway, "bye")); err != nil {
+		t.Fatal(err)
+	}
+	p.sendClose(CloseGoingAway, "")
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CloseWithReason didn't return after the peer's close frame")
+	}
+	if !isClosed(c) {
+		t.Error("connection was not closed")
+	}
+	if err := c.Write(OpText, []byte("late")); err == nil {
+		t.Error("wrote after closing")
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	c, peer := rawClient(t)
+	c.SetCloseTimeout(50 * time.Millisecond)
+	// The peer takes the close frame but never answers.
+	go io.Copy(io.Discard, peer)
+
+	start := time.Now()
+	c.CloseWithReason(CloseNormalClosure, "")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("CloseWithReason took %v", elapsed)
+	}
+	if !isClosed(c) {
+		t.Error("connection was not closed")
+	}
+}
+
+func TestCloseWithInvalidReason(t *testing.T) {
+	c, peer := rawClient(t)
+	tests := []struct {
+		code   int
+		reason string
+	}{
+		{999, ""},
+		{CloseNoStatusReceived, ""},
+		{CloseAbnormalClosure, ""},
+		{CloseTLSHandshake, ""},
+		{2000, ""},
+		{5000, ""},
+		{CloseNormalClosure, strings.Repeat("a", maxControlPayload-1)},
+		{CloseNormalClosure, "\xff"},
+	}
+	for _, tt := range tests {
+		if err := c.CloseWithReason(tt.code, tt.reason); err == nil {
+			t.Errorf("close with code %d and reason %q succeeded", tt.code, tt.reason)
+		}
+	}
+
+	// Nothing was sent, the connection is still open.
+	go c.Write(OpText, []byte("open"))
+	if err := pipePeer(peer).expect(OpText, []byte("open")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseClosePayload(t *testing.T) {
+	tests := []struct {
+		payload []byte
+		want    *CloseError
+		failure int
+	}{
+		{nil, &CloseError{Code: CloseNoStatusReceived}, 0},
+		{closePayload(CloseNormalClosure, ""), &CloseError{Code: CloseNormalClosure}, 0},
+		{closePayload(CloseGoingAway, "bye"), &CloseError{Code: CloseGoingAway, Reason: "bye"}, 0},
+		{closePayload(CloseTryAgainLater, ""), &CloseError{Code: CloseTryAgainLater}, 0},
+		{closePayload(3000, ""), &CloseError{Code: 3000}, 0},
+		{closePayload(4999, ""), &CloseError{Code: 4999}, 0},
+		{[]byte{0x03}, nil, CloseProtocolError},
+		{closePayload(999, ""), nil, CloseProtocolError},
+		{closePayload(CloseNoStatusReceived, ""), nil, CloseProtocolError},
+		{closePayload(CloseAbnormalClosure, ""), nil, CloseProtocolError},
+		{closePayload(CloseTLSHandshake, ""), nil, CloseProtocolError},
+		{closePayload(1016, ""), nil, CloseProtocolError},
+		{closePayload(5000, ""), nil, CloseProtocolError},
+		{closePayload(CloseNormalClosure, "\xff"), nil, CloseInvalidFramePayload},
+	}
+	for _, tt := range tests {
+		closeErr, failure := parseClosePayload(tt.payload)
+		if tt.want != nil && (closeErr == nil || *closeErr != *tt.want) {
+			t.Errorf("payload %q: got %v, want %v", tt.payload, closeErr, tt.want)
+		}
+		if (failure == nil && tt.failure != 0) || (failure != nil && failure.Code != tt.failure) {
+			t.Errorf("payload %q: got failure %v, want code %d", tt.payload, failure, tt.failure)
+		}
+	}
+}
+
+func TestCloseErrorAs(t *testing.T) {
+	err := fmt.Errorf("read: %w", &CloseError{Code: CloseGoingAway, Reason: "bye"})
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway {
+		t.Fatalf("errors.As didn't find the close error in %v", err)
+	}
+	if got := closeErr.Error(); !strings.Contains(got, "1001") || !strings.Contains(got, "bye") {
+		t.Errorf("got message %q", got)
+	}
+}
@@ -0,0 +1,51 @@
+package v13
+
+import "github.com/Walter-Sparrow/go-socket/socket/codec"
+
+// ReadJSON reads the next message and decodes it as JSON into v.
+func (c *Connection) ReadJSON(v any) error {
+	return readValue(c, codec.JSON, v)
+}
+
+// WriteJSON sends v encoded as JSON in a text message.
+func (c *Connection) WriteJSON(v any) error {
+	return writeValue(c, codec.JSON, v)
+}
+
+// ReadMessage reads the next message and decodes it with enc. A message that
+// doesn't decode is reported as a *codec.DecodeError and leaves the
+// connection usable.
+func ReadMessage[T any](c *Connection, enc codec.Codec) (T, error) {
+	var v T
+	err := readValue(c, enc, &v)
+	return v, err
+}
+
+// WriteMessage sends v encoded with enc, in a binary message if enc is a
+// binary codec and in a text message otherwise.
+func WriteMessage[T any](c *Connection, enc codec.Codec, v T) error {
+	return writeValue(c, enc, v)
+}
+
+func readValue(c *Connection, enc codec.Codec, v any) error {
+	_, message, err := c.Read()
+	if err != nil {
+		return err
+	}
+	if err := enc.Unmarshal(message, v); err != nil {
+		return &codec.DecodeError{Message: message, Err: err}
+	}
+	return nil
+}
+
+func writeValue(c *Connection, enc codec.Codec, v any) error {
+	message, err := enc.Marshal(v)
+	if err != nil {
+		return err
+	}
+	messageType := byte(OpText)
+	if enc.Binary() {
+		messageType = OpBinary
+	}
+	return c.Write(messageType, message)
+}
@@ -0,0 +1,67 @@
+package v13
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Walter-Sparrow/go-socket/socket/codec"
+)
+
+type codecMessage struct {
+	ID   int
+	Text string
+}
+
+func TestCodecMessages(t *testing.T) {
+	server, client := pipeConns(t)
+	go func() {
+		client.WriteJSON(codecMessage{1, "json"})
+		WriteMessage(client, codec.Gob, codecMessage{2, "gob"})
+		client.Write(OpText, []byte("{not json"))
+		WriteMessage(client, codec.JSON, codecMessage{3, "after"})
+	}()
+
+	var m codecMessage
+	if err := server.ReadJSON(&m); err != nil || m != (codecMessage{1, "json"}) {
+		t.Errorf("ReadJSON: got %+v and %v", m, err)
+	}
+	if m, err := ReadMessage[codecMessage](server, codec.Gob); err != nil || m != (codecMessage{2, "gob"}) {
+		t.Errorf("ReadMessage with gob: got %+v and %v", m, err)
+	}
+
+	_, err := ReadMessage[codecMessage](server, codec.JSON)
+	var decodeErr *codec.DecodeError
+	if !errors.As(err, &decodeErr) || string(decodeErr.Message) != "{not json" {
+		t.Errorf("got %v, want a decode error for the invalid message", err)
+	}
+	if m, err := ReadMessage[codecMessage](server, codec.JSON); err != nil || m != (codecMessage{3, "after"}) {
+		t.Errorf("read after a decode error: got %+v and %v", m, err)
+	}
+}
+
+func TestWriteMessageType(t *testing.T) {
+	codecs := []codec.Codec{codec.JSON, codec.Gob, codec.MsgPack, codec.CBOR}
+	server, client := pipeConns(t)
+	go func() {
+		for i, enc := range codecs {
+			WriteMessage(server, enc, codecMessage{i, "typed"})
+		}
+	}()
+	for i, enc := range codecs {
+		op, message, err := client.Read()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		want := byte(OpText)
+		if enc.Binary() {
+			want = OpBinary
+		}
+		if op != want {
+			t.Errorf("codec %d: got opcode %d, want %d", i, op, want)
+		}
+		var m codecMessage
+		if err := enc.Unmarshal(message, &m); err != nil || m != (codecMessage{i, "typed"}) {
+			t.Errorf("codec %d: got %+v and %v", i, m, err)
+		}
+	}
+}
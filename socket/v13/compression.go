@@ -0,0 +1,401 @@
+package v13
+
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	deflateExtension = "permessage-deflate"
+	// Every compressed message ends with an empty stored block that the
+	// sender strips and the receiver appends again (RFC 7692 7.2.1).
+	deflateTail = "\x00\x00\xff\xff"
+	// An empty final stored block lets the flate reader reach io.EOF.
+	deflateFinalBlock = "\x01\x00\x00\xff\xff"
+	maxWindowSize     = 1 << 15
+
+	defaultCompressionLevel = flate.BestSpeed
+)
+
+// compressionParams are the negotiated permessage-deflate parameters.
+type compressionParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+}
+
+func (p *compressionParams) String() string {
+	var sb strings.Builder
+	sb.WriteString(deflateExtension)
+	if p.serverNoContextTakeover {
+		sb.WriteString("; server_no_context_takeover")
+	}
+	if p.clientNoContextTakeover {
+		sb.WriteString("; client_no_context_takeover")
+	}
+	if p.serverMaxWindowBits != 0 {
+		sb.WriteString(fmt.Sprintf("; server_max_window_bits=%d", p.serverMaxWindowBits))
+	}
+	if p.clientMaxWindowBits != 0 {
+		sb.WriteString(fmt.Sprintf("; client_max_window_bits=%d", p.clientMaxWindowBits))
+	}
+	return sb.String()
+}
+
+type extension struct {
+	name   string
+	params [][2]string
+}
+
+// parseExtensions splits Sec-WebSocket-Extensions header values into
+// extensions and their parameters.
+func parseExtensions(headers http.Header) []extension {
+	var extensions []extension
+	for _, value := range headers.Values("Sec-WebSocket-Extensions") {
+		for _, element := range strings.Split(value, ",") {
+			parts := strings.Split(element, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+
+			ext := extension{name: strings.ToLower(name)}
+			for _, param := range parts[1:] {
+				key, value, _ := strings.Cut(param, "=")
+				key = strings.ToLower(strings.TrimSpace(key))
+				value = strings.Trim(strings.TrimSpace(value), `"`)
+				ext.params = append(ext.params, [2]string{key, value})
+			}
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions
+}
+
+// negotiateCompression picks the first permessage-deflate offer the server
+// can honour. compress/flate always uses a 32KB window, so offers that limit
+// the server's window are declined.
+func negotiateCompression(headers http.Header) *compressionParams {
+	for _, ext := range parseExtensions(headers) {
+		if ext.name != deflateExtension {
+			continue
+		}
+
+		params, err := parseCompressionParams(ext, true)
+		if err != nil || (params.serverMaxWindowBits != 0 && params.serverMaxWindowBits != 15) {
+			continue
+		}
+
+		// The client only announced support for the parameter, we don't
+		// need to limit its window.
+		params.clientMaxWindowBits = 0
+		return params
+	}
+	return nil
+}
+
+// acceptCompression validates the server's response to the client's offer.
+func acceptCompression(headers http.Header) (*compressionParams, error) {
+	var params *compressionParams
+	for _, ext := range parseExtensions(headers) {
+		if ext.name != deflateExtension || params != nil {
+			return nil, fmt.Errorf("client: Server selected extension %q that was not offered", ext.name)
+		}
+
+		var err error
+		params, err = parseCompressionParams(ext, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if params.clientMaxWindowBits != 0 {
+			return nil, fmt.Errorf("client: Server limited client_max_window_bits that was not offered")
+		}
+	}
+	return params, nil
+}
+
+func parseCompressionParams(ext extension, offer bool) (*compressionParams, error) {
+	params := &compressionParams{}
+	seen := make(map[string]bool)
+	for _, param := range ext.params {
+		key, value := param[0], param[1]
+		if seen[key] {
+			return nil, fmt.Errorf("conn: Duplicate extension parameter %s", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "server_no_context_takeover":
+			params.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			params.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, err := parseWindowBits(value)
+			if err != nil {
+				return nil, err
+			}
+			params.serverMaxWindowBits = bits
+		case "client_max_window_bits":
+			// Offers may send the parameter without a value.
+			if value == "" && offer {
+				params.clientMaxWindowBits = 15
+				continue
+			}
+			bits, err := parseWindowBits(value)
+			if err != nil {
+				return nil, err
+			}
+			params.clientMaxWindowBits = bits
+		default:
+			return nil, fmt.Errorf("conn: Unknown extension parameter %s", key)
+		}
+	}
+	return params, nil
+}
+
+func parseWindowBits(value string) (int, error) {
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < 8 || bits > 15 {
+		return 0, fmt.Errorf("conn: Invalid window bits %q", value)
+	}
+	return bits, nil
+}
+
+// EnableWriteCompression turns compression of subsequent messages on or off.
+// It has no effect unless permessage-deflate was negotiated.
+func (c *Connection) EnableWriteCompression(enable bool) {
+	c.lock(context.Background(), c.msgLock)
+	defer c.unlock(c.msgLock)
+	c.writeCompress = enable
+}
+
+// SetCompressionLevel sets the flate level used for outgoing messages.
+func (c *Connection) SetCompressionLevel(level int) error {
+	c.lock(context.Background(), c.msgLock)
+	defer c.unlock(c.msgLock)
+	if c.compressor == nil {
+		return nil
+	}
+	return c.compressor.setLevel(level)
+}
+
+func (c *Connection) setCompression(params *compressionParams) {
+	if params == nil {
+		return
+	}
+
+	writeNoContextTakeover := params.serverNoContextTakeover
+	readNoContextTakeover := params.clientNoContextTakeover
+	if !c.isServer {
+		writeNoContextTakeover, readNoContextTakeover = readNoContextTakeover, writeNoContextTakeover
+	}
+
+	c.compressor = &compressor{noContextTakeover: writeNoContextTakeover, level: defaultCompressionLevel}
+	c.decompressor = &decompressor{noContextTakeover: readNoContextTakeover}
+	c.writeCompress = true
+}
+
+type compressor struct {
+	noContextTakeover bool
+	level             int
+	fw                *flate.Writer
+	// The flate writer keeps writing to dst across messages, only the
+	// message writer behind it changes.
+	dst truncWriter
+	// out collects the message passed to compress.
+	out appendWriter
+}
+
+// writer returns a writer that compresses one message into w.
+func (c *compressor) writer(w io.WriteCloser) (io.WriteCloser, error) {
+	c.dst.w = w
+	c.dst.n = 0
+	if c.fw == nil {
+		fw, err := flate.NewWriter(&c.dst, c.level)
+		if err != nil {
+			return nil, err
+		}
+		c.fw = fw
+	} else if c.noContextTakeover {
+		c.fw.Reset(&c.dst)
+	}
+	return &compressWriter{c: c, w: w}, nil
+}
+
+// compress appends the compressed message to dst.
+func (c *compressor) compress(dst, message []byte) ([]byte, error) {
+	c.out.b = dst
+	defer func() { c.out.b = nil }()
+
+	w, err := c.writer(nopCloser{&c.out})
+	if err != nil {
+		return dst, err
+	}
+	if _, err := w.Write(message); err != nil {
+		return c.out.b, err
+	}
+	err = w.Close()
+	return c.out.b, err
+}
+
+// reset drops the compression context, the next message starts afresh.
+func (c *compressor) reset() {
+	c.fw = nil
+}
+
+func (c *compressor) setLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("conn: Invalid compression level %d", level)
+	}
+	c.level = level
+	c.fw = nil
+	return nil
+}
+
+type compressWriter struct {
+	c *compressor
+	w io.WriteCloser
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	return w.c.fw.Write(p)
+}
+
+func (w *compressWriter) Close() error {
+	err := w.c.fw.Flush()
+	if err == nil && (w.c.dst.n != len(deflateTail) || string(w.c.dst.tail[:]) != deflateTail) {
+		err = fmt.Errorf("conn: Unexpected end of compressed message")
+	}
+
+	// Always close the message writer, it releases the message lock.
+	if closeErr := w.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type appendWriter struct {
+	b []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// truncWriter forwards everything but the last four bytes written to it,
+// which is where the flushed deflate tail ends up.
+type truncWriter struct {
+	w    io.Writer
+	tail [4]byte
+	n    int
+}
+
+func (w *truncWriter) Write(p []byte) (int, error) {
+	written := len(p)
+
+	// Fill the tail before forwarding anything.
+	if w.n < len(w.tail) {
+		m := copy(w.tail[w.n:], p)
+		w.n += m
+		p = p[m:]
+		if len(p) == 0 {
+			return written, nil
+		}
+	}
+
+	// Forward the old tail and all of p except its last four bytes, which
+	// become the new tail.
+	m := min(len(p), len(w.tail))
+	if _, err := w.w.Write(w.tail[:m]); err != nil {
+		return 0, err
+	}
+	copy(w.tail[:], w.tail[m:])
+	copy(w.tail[len(w.tail)-m:], p[len(p)-m:])
+	if _, err := w.w.Write(p[:len(p)-m]); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+type decompressor struct {
+	noContextTakeover bool
+	fr                io.ReadCloser
+	// dict holds the recent output used as the window of the next message
+	// when the context is taken over.
+	dict []byte
+}
+
+// reader returns a reader that decompresses the message read from r.
+func (d *decompressor) reader(c *Connection, r io.Reader) io.Reader {
+	src := io.MultiReader(r, strings.NewReader(deflateTail+deflateFinalBlock))
+	dict := d.dict
+	if len(dict) > maxWindowSize {
+		dict = dict[len(dict)-maxWindowSize:]
+	}
+
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(src, dict)
+	} else {
+		d.fr.(flate.Resetter).Reset(src, dict)
+	}
+	return &decompressReader{c: c, d: d}
+}
+
+func (d *decompressor) record(p []byte) {
+	d.dict = append(d.dict, p...)
+	if len(d.dict) > 2*maxWindowSize {
+		d.dict = d.dict[:copy(d.dict, d.dict[len(d.dict)-maxWindowSize:])]
+	}
+}
+
+type decompressReader struct {
+	c *Connection
+	d *decompressor
+	// n counts the decompressed bytes against the read limit.
+	n int64
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	if limit := r.c.readLimit; limit > 0 && int64(len(p)) > limit-r.n+1 {
+		// Read one byte past the limit to tell an exact fit from an overflow.
+		p = p[:limit-r.n+1]
+	}
+
+	n, err := r.d.fr.Read(p)
+	if !r.d.noContextTakeover {
+		r.d.record(p[:n])
+	}
+
+	r.n += int64(n)
+	if limit := r.c.readLimit; limit > 0 && r.n > limit {
+		return 0, r.c.fail(CloseMessageTooBig, "Message exceeds the read limit")
+	}
+
+	// Errors of the frames underneath are already recorded. A timeout is
+	// not, but it breaks the decompressor, which can't resume the message.
+	// Anything else comes from corrupt compressed data.
+	switch {
+	case err == nil, err == io.EOF, r.c.readErr != nil:
+	case isTimeout(err):
+		err = r.c.readFailed(err)
+	default:
+		err = r.c.fail(CloseInvalidFramePayload, "Could not decompress message")
+	}
+	return n, err
+}
@@ -0,0 +1,187 @@
+package v13
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func extensionsHeader(values ...string) http.Header {
+	return http.Header{"Sec-Websocket-Extensions": values}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		offer []string
+		// want is the response, empty when the offer is declined.
+		want string
+	}{
+		{nil, ""},
+		{[]string{"permessage-deflate"}, "permessage-deflate"},
+		{[]string{"Permessage-Deflate; SERVER_NO_CONTEXT_TAKEOVER"}, "permessage-deflate; server_no_context_takeover"},
+		{[]string{"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		// The client's window is never limited.
+		{[]string{"permessage-deflate; client_max_window_bits"}, "permessage-deflate"},
+		{[]string{"permessage-deflate; client_max_window_bits=10"}, "permessage-deflate"},
+		{[]string{"permessage-deflate; server_max_window_bits=15"}, "permessage-deflate; server_max_window_bits=15"},
+		{[]string{`permessage-deflate; server_max_window_bits="15"`}, "permessage-deflate; server_max_window_bits=15"},
+		// compress/flate can't write with a smaller window.
+		{[]string{"permessage-deflate; server_max_window_bits=10"}, ""},
+		{[]string{"permessage-deflate; server_max_window_bits=8"}, ""},
+		{[]string{"permessage-deflate; server_max_window_bits=10, permessage-deflate"}, "permessage-deflate"},
+		{[]string{"permessage-deflate; server_max_window_bits=10", "permessage-deflate; client_no_context_takeover"},
+			"permessage-deflate; client_no_context_takeover"},
+		{[]string{"permessage-deflate; server_max_window_bits"}, ""},
+		{[]string{"permessage-deflate; server_max_window_bits=16"}, ""},
+		{[]string{"permessage-deflate; server_max_window_bits=7"}, ""},
+		{[]string{"permessage-deflate; server_max_window_bits=abc"}, ""},
+		{[]string{"permessage-deflate; client_max_window_bits=16"}, ""},
+		{[]string{"permessage-deflate; server_no_context_takeover; server_no_context_takeover"}, ""},
+		{[]string{"permessage-deflate; client_max_window_bits; client_max_window_bits=10"}, ""},
+		{[]string{"permessage-deflate; unknown_parameter"}, ""},
+		{[]string{"permessage-deflate; unknown_parameter, permessage-deflate"}, "permessage-deflate"},
+		{[]string{"x-webkit-deflate-frame"}, ""},
+		{[]string{"x-webkit-deflate-frame, permessage-deflate"}, "permessage-deflate"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if params := negotiateCompression(extensionsHeader(tt.offer...)); params != nil {
+			got = params.String()
+		}
+		if got != tt.want {
+			t.Errorf("offer %q: got %q, want %q", tt.offer, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptCompression(t *testing.T) {
+	tests := []struct {
+		response string
+		want     string
+		ok       bool
+	}{
+		{"", "", true},
+		{"permessage-deflate", "permessage-deflate", true},
+		{"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover", true},
+		{"permessage-deflate; server_max_window_bits=10", "permessage-deflate; server_max_window_bits=10", true},
+		// The client never offers client_max_window_bits.
+		{"permessage-deflate; client_max_window_bits=10", "", false},
+		{"permessage-deflate; client_max_window_bits", "", false},
+		{"permessage-deflate; server_max_window_bits=16", "", false},
+		{"permessage-deflate; server_no_context_takeover; server_no_context_takeover", "", false},
+		{"permessage-deflate; unknown_parameter", "", false},
+		{"permessage-deflate, permessage-deflate", "", false},
+		{"x-webkit-deflate-frame", "", false},
+		{"permessage-deflate, x-webkit-deflate-frame", "", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.response != "" {
+			header = extensionsHeader(tt.response)
+		}
+		params, err := acceptCompression(header)
+		if (err == nil) != tt.ok {
+			t.Errorf("response %q: got error %v, want ok %v", tt.response, err, tt.ok)
+			continue
+		}
+		got := ""
+		if params != nil {
+			got = params.String()
+		}
+		if got != tt.want {
+			t.Errorf("response %q: got %q, want %q", tt.response, got, tt.want)
+		}
+	}
+}
+
+// TestDialUnofferedExtension checks that clients refuse extensions they did
+// not offer.
+func TestDialUnofferedExtension(t *testing.T) {
+	tests := []struct {
+		compression bool
+		response    string
+	}{
+		{false, "permessage-deflate"},
+		{true, "x-webkit-deflate-frame"},
+		{true, "permessage-deflate; client_max_window_bits=10"},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Accept: %s\r\nSec-WebSocket-Extensions: %s\r\n\r\n",
+				computeAcceptKey(r.Header.Get("Sec-WebSocket-Key")), tt.response)
+			buf.Flush()
+		}))
+
+		url := "ws" + strings.TrimPrefix(srv.URL, "http")
+		c, err := Dial(context.Background(), url, &DialOptions{EnableCompression: tt.compression})
+		if err == nil {
+			c.Close()
+			t.Errorf("compression %v, response %q: dial succeeded", tt.compression, tt.response)
+		}
+		srv.Close()
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	url := newTestServer(t, &Upgrader{EnableCompression: true}, func(c *Connection) {
+		for {
+			op, message, err := c.Read()
+			if err != nil {
+				return
+			}
+			c.Write(op, message)
+		}
+	})
+	c := dialTest(t, url, &DialOptions{EnableCompression: true})
+	if c.compressor == nil {
+		t.Fatal("compression was not negotiated")
+	}
+
+	json := []byte(strings.Repeat(`{"id":1,"name":"order","items":[1,2,3]},`, 200))
+	messages := [][]byte{json, []byte("short"), json, nil, []byte(strings.Repeat("x", 70000))}
+	for i, message := range messages {
+		// The middle messages go out uncompressed.
+		c.EnableWriteCompression(i != 2 && i != 3)
+		if err := c.Write(OpBinary, message); err != nil {
+			t.Fatal(err)
+		}
+		if _, got, err := c.Read(); err != nil || !bytes.Equal(got, message) {
+			t.Fatalf("message %d: got %d bytes and %v, want %d bytes", i, len(got), err, len(message))
+		}
+	}
+}
+
+func TestWriteCompression(t *testing.T) {
+	c, peer := rawClient(t)
+	c.setCompression(&compressionParams{})
+	br := bufio.NewReader(peer)
+	message := []byte(strings.Repeat("compress me ", 100))
+
+	for _, enable := range []bool{true, false} {
+		c.EnableWriteCompression(enable)
+		go c.Write(OpText, message)
+		frame, err := ReadFrame(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Rsv1 != enable {
+			t.Errorf("compression %v: got RSV1 %v", enable, frame.Rsv1)
+		}
+		if enable && len(frame.Payload) >= len(message) {
+			t.Errorf("compressed payload of %d bytes isn't smaller than the message", len(frame.Payload))
+		}
+	}
+}
@@ -0,0 +1,606 @@
+package v13
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The conformance suite replays the case categories of the Autobahn
+// TestSuite against an echo server built on Upgrade. Run it with
+//
+//	go test -run TestConformance -v ./socket/v13 -args -conformance.report=report.txt
+//
+// to get the per-case report in a file as well as in the test log.
+var conformanceReport = flag.String("conformance.report", "", "write the conformance report to this file")
+
+const (
+	conformanceReadLimit = 1 << 17
+	conformanceTimeout   = 5 * time.Second
+)
+
+type conformanceCase struct {
+	id          string
+	description string
+	run         func(p *rawPeer) error
+}
+
+type conformanceResult struct {
+	conformanceCase
+	err error
+}
+
+func TestConformance(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		echo(c)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http"))
+
+	var results []conformanceResult
+	for _, tc := range conformanceCases() {
+		var err error
+		t.Run(tc.id, func(t *testing.T) {
+			p, dialErr := dialRaw(u)
+			if dialErr != nil {
+				t.Fatalf("dial: %v", dialErr)
+			}
+			defer p.conn.Close()
+
+			if err = tc.run(p); err != nil {
+				t.Errorf("%s: %v", tc.description, err)
+			}
+		})
+		results = append(results, conformanceResult{tc, err})
+	}
+
+	report := conformanceReportText(results)
+	t.Log("\n" + report)
+	if *conformanceReport != "" {
+		if err := os.WriteFile(*conformanceReport, []byte(report), 0o644); err != nil {
+			t.Errorf("write report: %v", err)
+		}
+	}
+}
+
+// echo sends every message back, like the Autobahn echo server.
+func echo(c *Connection) {
+	c.SetReadLimit(conformanceReadLimit)
+	for {
+		op, message, err := c.Read()
+		if err != nil {
+			c.Close()
+			return
+		}
+		if err := c.Write(op, message); err != nil {
+			return
+		}
+	}
+}
+
+func conformanceReportText(results []conformanceResult) string {
+	var sb strings.Builder
+	passed := 0
+	fmt.Fprintf(&sb, "%-8s %-6s %s\n", "Case", "Result", "Description")
+	for _, r := range results {
+		result := "PASS"
+		if r.err != nil {
+			result = "FAIL"
+		} else {
+			passed++
+		}
+		fmt.Fprintf(&sb, "%-8s %-6s %s\n", r.id, result, r.description)
+		if r.err != nil {
+			fmt.Fprintf(&sb, "%-8s %-6s %v\n", "", "", r.err)
+		}
+	}
+	fmt.Fprintf(&sb, "Passed %d of %d cases\n", passed, len(results))
+	return sb.String()
+}
+
+// rawPeer is a client that writes frames byte for byte as the case asks,
+// including frames Connection would never send.
+type rawPeer struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialRaw(u *url.URL) (*rawPeer, error) {
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(conformanceTimeout))
+
+	br := bufio.NewReader(conn)
+	if _, _, err := clientHandshake(conn, br, u, &DialOptions{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &rawPeer{conn: conn, br: br}, nil
+}
+
+// clientFrame returns a frame masked like a client must.
+func clientFrame(fin bool, opcode byte, payload []byte) *Frame {
+	f := NewFrame(fin, opcode, true, [4]byte{0x37, 0xfa, 0x21, 0x3d}, bytes.Clone(payload))
+	f.MaskPayload()
+	return f
+}
+
+func (p *rawPeer) send(fin bool, opcode byte, payload []byte) error {
+	return p.sendFrame(clientFrame(fin, opcode, payload))
+}
+
+func (p *rawPeer) sendFrame(frames ...*Frame) error {
+	var b []byte
+	for _, f := range frames {
+		b = append(b, f.Bytes()...)
+	}
+	_, err := p.conn.Write(b)
+	return err
+}
+
+// sendChopped writes the frame in chunks of the given size.
+func (p *rawPeer) sendChopped(fin bool, opcode byte, payload []byte, chunk int) error {
+	b := clientFrame(fin, opcode, payload).Bytes()
+	for len(b) > 0 {
+		n := min(chunk, len(b))
+		if _, err := p.conn.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func (p *rawPeer) sendClose(code int, reason string) error {
+	return p.sendFrame(clientFrame(true, OpClose, closePayload(code, reason)))
+}
+
+// expect reads the next frame and compares it to the given one.
+func (p *rawPeer) expect(opcode byte, payload []byte) error {
+	f, err := ReadFrame(p.br)
+	if err != nil {
+		return fmt.Errorf("expected opcode %d, got %v", opcode, err)
+	}
+	if f.Opcode != opcode || !f.Fin {
+		return fmt.Errorf("expected opcode %d, got opcode %d with fin %v", opcode, f.Opcode, f.Fin)
+	}
+	if !bytes.Equal(f.Payload, payload) {
+		return fmt.Errorf("opcode %d: payload of %d bytes differs from the %d bytes expected", opcode, len(f.Payload), len(payload))
+	}
+	return nil
+}
+
+// expectClose reads the next frame, which must be a close frame with code,
+// and then waits for the server to drop the connection. CloseNoStatusReceived
+// stands for a close frame without payload.
+func (p *rawPeer) expectClose(code int) error {
+	f, err := ReadFrame(p.br)
+	if err != nil {
+		return fmt.Errorf("expected close %d, got %v", code, err)
+	}
+	if f.Opcode != OpClose {
+		return fmt.Errorf("expected close %d, got opcode %d", code, f.Opcode)
+	}
+
+	got := CloseNoStatusReceived
+	if len(f.Payload) >= 2 {
+		got = int(binary.BigEndian.Uint16(f.Payload))
+	}
+	if got != code {
+		return fmt.Errorf("expected close %d, got close %d %q", code, got, f.Payload)
+	}
+
+	if _, err := p.br.ReadByte(); err == nil || isTimeout(err) {
+		return fmt.Errorf("connection was not closed after the close frame")
+	}
+	return nil
+}
+
+// closeNormally finishes a case with a closing handshake started by the peer.
+func (p *rawPeer) closeNormally() error {
+	if err := p.sendClose(CloseNormalClosure, ""); err != nil {
+		return err
+	}
+	return p.expectClose(CloseNormalClosure)
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// echoCase sends a single message and expects it back.
+func echoCase(opcode byte, payload []byte) func(p *rawPeer) error {
+	return func(p *rawPeer) error {
+		if err := p.send(true, opcode, payload); err != nil {
+			return err
+		}
+		if err := p.expect(opcode, payload); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	}
+}
+
+// failCase sends the frames and expects the server to fail the connection
+// with code.
+func failCase(code int, frames ...*Frame) func(p *rawPeer) error {
+	return func(p *rawPeer) error {
+		if err := p.sendFrame(frames...); err != nil {
+			return err
+		}
+		return p.expectClose(code)
+	}
+}
+
+// echoThenFailCase expects the first message back before the rest of the
+// frames fail the connection.
+func echoThenFailCase(code int, opcode byte, payload []byte, frames ...*Frame) func(p *rawPeer) error {
+	return func(p *rawPeer) error {
+		if err := p.send(true, opcode, payload); err != nil {
+			return err
+		}
+		if err := p.expect(opcode, payload); err != nil {
+			return err
+		}
+		if err := p.sendFrame(frames...); err != nil {
+			return err
+		}
+		return p.expectClose(code)
+	}
+}
+
+func withRsv(f *Frame, rsv byte) *Frame {
+	f.Rsv1 = rsv&4 != 0
+	f.Rsv2 = rsv&2 != 0
+	f.Rsv3 = rsv&1 != 0
+	return f
+}
+
+func conformanceCases() []conformanceCase {
+	var cases []conformanceCase
+	add := func(id, description string, run func(p *rawPeer) error) {
+		cases = append(cases, conformanceCase{id, description, run})
+	}
+
+	// 1 Framing
+	lengths := []int{0, 125, 126, 127, 128, 65535, 65536}
+	for i, n := range lengths {
+		add(fmt.Sprintf("1.1.%d", i+1), fmt.Sprintf("Text message with payload length %d", n),
+			echoCase(OpText, bytes.Repeat([]byte("*"), n)))
+	}
+	add("1.1.8", "Text message with payload length 65536 sent in chops of 997 bytes", func(p *rawPeer) error {
+		payload := bytes.Repeat([]byte("*"), 65536)
+		if err := p.sendChopped(true, OpText, payload, 997); err != nil {
+			return err
+		}
+		if err := p.expect(OpText, payload); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	for i, n := range lengths {
+		add(fmt.Sprintf("1.2.%d", i+1), fmt.Sprintf("Binary message with payload length %d", n),
+			echoCase(OpBinary, bytes.Repeat([]byte{0xfe}, n)))
+	}
+
+	// 2 Pings and pongs
+	pingCase := func(payload []byte) func(p *rawPeer) error {
+		return func(p *rawPeer) error {
+			if err := p.send(true, OpPing, payload); err != nil {
+				return err
+			}
+			if err := p.expect(OpPong, payload); err != nil {
+				return err
+			}
+			return p.closeNormally()
+		}
+	}
+	add("2.1", "Ping without payload", pingCase(nil))
+	add("2.2", "Ping with small text payload", pingCase([]byte("Hello, world!")))
+	add("2.3", "Ping with small binary payload", pingCase([]byte{0x00, 0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0x00, 0xff}))
+	add("2.4", "Ping with 125 byte payload", pingCase(bytes.Repeat([]byte{0xfe}, 125)))
+	add("2.5", "Ping with 126 byte payload", failCase(CloseProtocolError, clientFrame(true, OpPing, bytes.Repeat([]byte{0xfe}, 126))))
+	add("2.6", "Ping with 125 byte payload sent in chops of 1 byte", func(p *rawPeer) error {
+		payload := bytes.Repeat([]byte{0xfe}, 125)
+		if err := p.sendChopped(true, OpPing, payload, 1); err != nil {
+			return err
+		}
+		if err := p.expect(OpPong, payload); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	add("2.7", "Unsolicited pong without payload", func(p *rawPeer) error {
+		if err := p.send(true, OpPong, nil); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	add("2.8", "Unsolicited pong with payload", func(p *rawPeer) error {
+		if err := p.send(true, OpPong, []byte("unsolicited pong payload")); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	add("2.9", "Unsolicited pong followed by a ping", func(p *rawPeer) error {
+		if err := p.sendFrame(clientFrame(true, OpPong, []byte("unsolicited pong payload")), clientFrame(true, OpPing, []byte("ping payload"))); err != nil {
+			return err
+		}
+		if err := p.expect(OpPong, []byte("ping payload")); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	add("2.10", "Ten pings in a row", func(p *rawPeer) error {
+		for i := 0; i < 10; i++ {
+			if err := p.send(true, OpPing, []byte(fmt.Sprintf("payload-%d", i))); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < 10; i++ {
+			if err := p.expect(OpPong, []byte(fmt.Sprintf("payload-%d", i))); err != nil {
+				return err
+			}
+		}
+		return p.closeNormally()
+	})
+
+	// 3 Reserved bits
+	add("3.1", "Text message with RSV = 1", failCase(CloseProtocolError, withRsv(clientFrame(true, OpText, []byte("Hello, world!")), 1)))
+	add("3.2", "Valid text message, then text message with RSV = 2", echoThenFailCase(CloseProtocolError, OpText, []byte("Hello, world!"),
+		withRsv(clientFrame(true, OpText, []byte("Hello, world!")), 2)))
+	add("3.3", "Text message with RSV = 3", failCase(CloseProtocolError, withRsv(clientFrame(true, OpText, []byte("Hello, world!")), 3)))
+	add("3.4", "Text message with RSV = 4 without negotiated compression", failCase(CloseProtocolError, withRsv(clientFrame(true, OpText, []byte("Hello, world!")), 4)))
+	add("3.5", "Binary message with RSV = 5", failCase(CloseProtocolError, withRsv(clientFrame(true, OpBinary, []byte{0x00, 0xff}), 5)))
+	add("3.6", "Ping with RSV = 6", failCase(CloseProtocolError, withRsv(clientFrame(true, OpPing, []byte("Hello, world!")), 6)))
+	add("3.7", "Close with RSV = 7", failCase(CloseProtocolError, withRsv(clientFrame(true, OpClose, nil), 7)))
+
+	// 4 Opcodes
+	for i, op := range []byte{3, 4, 5, 6, 7} {
+		add(fmt.Sprintf("4.1.%d", i+1), fmt.Sprintf("Reserved non-control opcode %d", op), failCase(CloseProtocolError, clientFrame(true, op, nil)))
+	}
+	add("4.1.6", "Valid text message, then reserved opcode 3 with payload", echoThenFailCase(CloseProtocolError, OpText, []byte("Hello, world!"),
+		clientFrame(true, 3, []byte("reserved"))))
+	for i, op := range []byte{11, 12, 13, 14, 15} {
+		add(fmt.Sprintf("4.2.%d", i+1), fmt.Sprintf("Reserved control opcode %d", op), failCase(CloseProtocolError, clientFrame(true, op, nil)))
+	}
+
+	// 5 Fragmentation
+	add("5.1", "Ping in two fragments", failCase(CloseProtocolError,
+		clientFrame(false, OpPing, []byte("fragment1")), clientFrame(true, OpContinuation, []byte("fragment2"))))
+	add("5.2", "Pong in two fragments", failCase(CloseProtocolError,
+		clientFrame(false, OpPong, []byte("fragment1")), clientFrame(true, OpContinuation, []byte("fragment2"))))
+	add("5.3", "Text message in two fragments", func(p *rawPeer) error {
+		if err := p.sendFrame(clientFrame(false, OpText, []byte("fragment1")), clientFrame(true, OpContinuation, []byte("fragment2"))); err != nil {
+			return err
+		}
+		if err := p.expect(OpText, []byte("fragment1fragment2")); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	add("5.4", "Text message in two fragments sent one by one", func(p *rawPeer) error {
+		if err := p.send(false, OpText, []byte("fragment1")); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := p.send(true, OpContinuation, []byte("fragment2")); err != nil {
+			return err
+		}
+		if err := p.expect(OpText, []byte("fragment1fragment2")); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	add("5.5", "Text message in two fragments with a ping in between", func(p *rawPeer) error {
+		if err := p.sendFrame(clientFrame(false, OpText, []byte("fragment1")), clientFrame(true, OpPing, []byte("ping")),
+			clientFrame(true, OpContinuation, []byte("fragment2"))); err != nil {
+			return err
+		}
+		if err := p.expect(OpPong, []byte("ping")); err != nil {
+			return err
+		}
+		if err := p.expect(OpText, []byte("fragment1fragment2")); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	add("5.6", "Binary message in many fragments with pings in between", func(p *rawPeer) error {
+		var frames []*Frame
+		var want []byte
+		for i := 0; i < 10; i++ {
+			op := byte(OpContinuation)
+			if i == 0 {
+				op = OpBinary
+			}
+			payload := bytes.Repeat([]byte{byte(i)}, 100)
+			want = append(want, payload...)
+			frames = append(frames, clientFrame(i == 9, op, payload), clientFrame(true, OpPing, []byte{byte(i)}))
+		}
+		if err := p.sendFrame(frames...); err != nil {
+			return err
+		}
+		// The message is complete after the last fragment, before the last
+		// ping was read.
+		for i := 0; i < 9; i++ {
+			if err := p.expect(OpPong, []byte{byte(i)}); err != nil {
+				return err
+			}
+		}
+		if err := p.expect(OpBinary, want); err != nil {
+			return err
+		}
+		if err := p.expect(OpPong, []byte{9}); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	add("5.7", "Continuation frame without a message start", failCase(CloseProtocolError, clientFrame(true, OpContinuation, []byte("fragment"))))
+	add("5.8", "Unfinished continuation frame without a message start", failCase(CloseProtocolError, clientFrame(false, OpContinuation, []byte("fragment"))))
+	add("5.9", "New text message inside a fragmented text message", failCase(CloseProtocolError,
+		clientFrame(false, OpText, []byte("fragment1")), clientFrame(true, OpText, []byte("fragment2"))))
+	add("5.10", "Valid fragmented message, then a continuation frame", func(p *rawPeer) error {
+		if err := p.sendFrame(clientFrame(false, OpText, []byte("fragment1")), clientFrame(true, OpContinuation, []byte("fragment2"))); err != nil {
+			return err
+		}
+		if err := p.expect(OpText, []byte("fragment1fragment2")); err != nil {
+			return err
+		}
+		if err := p.send(true, OpContinuation, []byte("fragment3")); err != nil {
+			return err
+		}
+		return p.expectClose(CloseProtocolError)
+	})
+	add("5.11", "Empty fragments", func(p *rawPeer) error {
+		if err := p.sendFrame(clientFrame(false, OpText, nil), clientFrame(false, OpContinuation, nil), clientFrame(true, OpContinuation, nil)); err != nil {
+			return err
+		}
+		if err := p.expect(OpText, []byte{}); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+
+	// 6 UTF-8 handling
+	add("6.1", "Empty text message", echoCase(OpText, nil))
+	add("6.2", "Valid UTF-8 text message", echoCase(OpText, []byte("Hello-µ@ßöäüàá-UTF-8!!")))
+	add("6.3", "Valid UTF-8 split in the middle of runes across fragments", func(p *rawPeer) error {
+		text := []byte("κόσμε \U0001F600 €")
+		var frames []*Frame
+		for i := 0; i < len(text); i++ {
+			op := byte(OpContinuation)
+			if i == 0 {
+				op = OpText
+			}
+			frames = append(frames, clientFrame(i == len(text)-1, op, text[i:i+1]))
+		}
+		if err := p.sendFrame(frames...); err != nil {
+			return err
+		}
+		if err := p.expect(OpText, text); err != nil {
+			return err
+		}
+		return p.closeNormally()
+	})
+	invalid := []struct {
+		description string
+		text        string
+	}{
+		{"Invalid continuation byte", "κόσμε\xed"},
+		{"Lone continuation byte", "\x80"},
+		{"Invalid lead byte 0xff", "ab\xff"},
+		{"Overlong encoding of '/'", "\xc0\xaf"},
+		{"Overlong encoding of U+0000", "\xe0\x80\x80"},
+		{"UTF-16 surrogate U+D800", "\xed\xa0\x80"},
+		{"Code point above U+10FFFF", "\xf4\x90\x80\x80"},
+		{"Five byte sequence", "\xf8\x88\x80\x80\x80"},
+		{"Truncated three byte sequence", "\xe2\x82"},
+	}
+	for i, tc := range invalid {
+		add(fmt.Sprintf("6.4.%d", i+1), tc.description, failCase(CloseInvalidFramePayload, clientFrame(true, OpText, []byte(tc.text))))
+	}
+	add("6.5.1", "Invalid UTF-8 in the first fragment fails before the message ends", failCase(CloseInvalidFramePayload,
+		clientFrame(false, OpText, []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xf4\x90\x80\x80"))))
+	add("6.5.2", "Invalid UTF-8 spread over fragments", failCase(CloseInvalidFramePayload,
+		clientFrame(false, OpText, []byte("\xed")), clientFrame(false, OpContinuation, []byte("\xa0")), clientFrame(true, OpContinuation, []byte("\x80"))))
+	add("6.5.3", "Invalid UTF-8 in a binary message is allowed", echoCase(OpBinary, []byte("\xff\xfe\xed\xa0\x80")))
+
+	// 7 Close handling
+	add("7.1.1", "Echo a text message, then close", echoCase(OpText, []byte("Hello, world!")))
+	add("7.1.2", "Close twice", func(p *rawPeer) error {
+		if err := p.sendFrame(clientFrame(true, OpClose, closePayload(CloseNormalClosure, "")),
+			clientFrame(true, OpClose, closePayload(CloseNormalClosure, ""))); err != nil {
+			return err
+		}
+		return p.expectClose(CloseNormalClosure)
+	})
+	add("7.1.3", "Ping after close", func(p *rawPeer) error {
+		if err := p.sendFrame(clientFrame(true, OpClose, closePayload(CloseNormalClosure, "")), clientFrame(true, OpPing, []byte("ping"))); err != nil {
+			return err
+		}
+		return p.expectClose(CloseNormalClosure)
+	})
+	add("7.1.4", "Text message after close", func(p *rawPeer) error {
+		if err := p.sendFrame(clientFrame(true, OpClose, closePayload(CloseNormalClosure, "")), clientFrame(true, OpText, []byte("late"))); err != nil {
+			return err
+		}
+		return p.expectClose(CloseNormalClosure)
+	})
+	add("7.1.5", "Close in the middle of a fragmented message", func(p *rawPeer) error {
+		if err := p.sendFrame(clientFrame(false, OpText, []byte("fragment1")), clientFrame(true, OpClose, closePayload(CloseNormalClosure, ""))); err != nil {
+			return err
+		}
+		return p.expectClose(CloseNormalClosure)
+	})
+	add("7.3.1", "Close without payload", func(p *rawPeer) error {
+		if err := p.send(true, OpClose, nil); err != nil {
+			return err
+		}
+		return p.expectClose(CloseNoStatusReceived)
+	})
+	add("7.3.2", "Close with a payload of 1 byte", failCase(CloseProtocolError, clientFrame(true, OpClose, []byte{0x03})))
+	add("7.3.3", "Close with a status code and no reason", func(p *rawPeer) error {
+		return p.closeNormally()
+	})
+	add("7.3.4", "Close with a status code and a reason", func(p *rawPeer) error {
+		if err := p.sendClose(CloseNormalClosure, "Hello World!"); err != nil {
+			return err
+		}
+		return p.expectClose(CloseNormalClosure)
+	})
+	add("7.3.5", "Close with a reason of 123 bytes", func(p *rawPeer) error {
+		if err := p.sendClose(CloseNormalClosure, strings.Repeat("*", 123)); err != nil {
+			return err
+		}
+		return p.expectClose(CloseNormalClosure)
+	})
+	add("7.3.6", "Close with a reason of 124 bytes", failCase(CloseProtocolError, clientFrame(true, OpClose, closePayload(CloseNormalClosure, strings.Repeat("*", 124)))))
+	add("7.5.1", "Close with a reason that is not valid UTF-8", failCase(CloseInvalidFramePayload, clientFrame(true, OpClose, closePayload(CloseNormalClosure, "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80"))))
+	for i, code := range []int{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		add(fmt.Sprintf("7.7.%d", i+1), fmt.Sprintf("Close with valid status code %d", code), func(p *rawPeer) error {
+			if err := p.sendClose(code, ""); err != nil {
+				return err
+			}
+			return p.expectClose(code)
+		})
+	}
+	for i, code := range []int{0, 999, 1004, 1005, 1006, 1015, 1016, 1100, 2000, 2999, 5000, 65535} {
+		add(fmt.Sprintf("7.9.%d", i+1), fmt.Sprintf("Close with invalid status code %d", code),
+			failCase(CloseProtocolError, clientFrame(true, OpClose, closePayload(code, ""))))
+	}
+
+	// 9 Limits
+	add("9.1.1", "Message of exactly the read limit", echoCase(OpBinary, bytes.Repeat([]byte{0x2a}, conformanceReadLimit)))
+	add("9.1.2", "Message one byte over the read limit", func(p *rawPeer) error {
+		// The server may stop reading before the whole frame arrived.
+		p.send(true, OpBinary, bytes.Repeat([]byte{0x2a}, conformanceReadLimit+1))
+		return p.expectClose(CloseMessageTooBig)
+	})
+	add("9.1.3", "Fragmented message over the read limit", func(p *rawPeer) error {
+		half := bytes.Repeat([]byte{0x2a}, conformanceReadLimit/2+1)
+		p.sendFrame(clientFrame(false, OpBinary, half), clientFrame(true, OpContinuation, half))
+		return p.expectClose(CloseMessageTooBig)
+	})
+
+	// 10 Masking
+	add("10.1.1", "Unmasked text message from the client", failCase(CloseProtocolError, NewTextFrame([]byte("Hello, world!"))))
+	add("10.1.2", "Unmasked ping from the client", failCase(CloseProtocolError, NewFrame(true, OpPing, false, [4]byte{}, []byte("ping"))))
+
+	return cases
+}
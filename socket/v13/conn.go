@@ -2,42 +2,435 @@ package v13
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 const (
-	defaultReadBufferSize = 4096
+	defaultBufferSize = 4096
 )
 
+// ErrCloseSent is returned when writing after a close frame was sent.
+var ErrCloseSent = errors.New("conn: Close frame already sent")
+
+// Connection supports one concurrent reader and any number of concurrent
+// writers. Read, NextReader and the setters of the read side (SetPongHandler,
+// SetReadLimit) belong to the reading goroutine. Write, NextWriter,
+// CloseWithReason, Close, Done, SetKeepalive, Stats and the deadline setters
+// may be called from any goroutine: frames are written whole under a lock,
+// data messages are written one at a time, and control frames may go out
+// between the fragments of a data message.
 type Connection struct {
-	conn net.Conn
-	br   *bufio.Reader
+	conn        net.Conn
+	br          *bufio.Reader
+	isServer    bool
+	subprotocol string
+	pongHandler func(appData []byte)
+
+	// writeLock guards closeSent and writeErr and is held while writing a
+	// frame. Both locks are channels so that waiting for them can be
+	// cancelled.
+	writeLock chan struct{}
+	closeSent bool
+	// writeErr is returned by every write once a frame was cut off.
+	writeErr error
+	// Header buffer and writev vector of the frame being written.
+	writeHeader [maxHeaderSize]byte
+	writeVec    [2][]byte
+	writeBufs   net.Buffers
+	// msgLock is held for the whole of a data message, from NextWriter until
+	// its writer is closed, and guards the compression state. It is taken
+	// before writeLock.
+	msgLock         chan struct{}
+	writeBufferSize int
+
+	// deadlineMu guards the deadlines and closeTimeout.
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closeTimeout  time.Duration
+
+	// readMu is held by the reading goroutine while it reads frames, so
+	// CloseWithReason knows whether it has to read the peer's close itself.
+	readMu        sync.Mutex
+	closeReceived chan struct{}
+	// closed is closed together with the underlying connection.
+	closed        chan struct{}
+	closeOnce     sync.Once
+	closeRecvOnce sync.Once
+
+	keepalive keepalive
+
+	// permessage-deflate state, nil unless negotiated.
+	compressor    *compressor
+	decompressor  *decompressor
+	writeCompress bool
+
+	// readErr is returned by every read once the connection failed.
+	readErr error
+	// reader is the message handed out by NextReader and msgReader the
+	// frame reader underneath it.
+	reader    io.Reader
+	msgReader *messageReader
+	// readLimit caps the size of a message, zero means no limit.
+	readLimit int64
+	// readLength is the number of payload bytes of the current message.
+	readLength int64
+	// readHeader is the last frame header read and controlBuf holds the
+	// payload of control frames.
+	readHeader Frame
+	controlBuf [maxControlPayload]byte
+	// State of the data frame whose payload is being read.
+	readRemaining int64
+	readFinal     bool
+	readMasked    bool
+	readMaskKey   [4]byte
+	readMaskPos   int
 }
 
 func NewConnection(conn net.Conn) *Connection {
-	br := bufio.NewReaderSize(conn, defaultReadBufferSize)
-	return &Connection{conn: conn, br: br}
+	br := bufio.NewReaderSize(conn, defaultBufferSize)
+	return newConnection(conn, br, defaultBufferSize, true)
+}
+
+func newConnection(conn net.Conn, br *bufio.Reader, writeBufferSize int, isServer bool) *Connection {
+	return &Connection{
+		conn:            conn,
+		br:              br,
+		isServer:        isServer,
+		writeLock:       make(chan struct{}, 1),
+		msgLock:         make(chan struct{}, 1),
+		writeBufferSize: writeBufferSize,
+		closeReceived:   make(chan struct{}),
+		closed:          make(chan struct{}),
+		closeTimeout:    defaultCloseTimeout,
+	}
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake, if any.
+func (c *Connection) Subprotocol() string {
+	return c.subprotocol
+}
+
+// SetPongHandler sets the function called with the payload of every pong
+// frame received by Read. appData is only valid until the handler returns.
+func (c *Connection) SetPongHandler(h func(appData []byte)) {
+	c.pongHandler = h
 }
 
+// SetReadLimit sets the maximum size in bytes of a message read from the peer,
+// counted after decompression. Larger messages fail the connection with
+// CloseMessageTooBig. Zero or less removes the limit.
+func (c *Connection) SetReadLimit(limit int64) {
+	c.readLimit = max(limit, 0)
+}
+
+// Close closes the underlying connection without a close frame
 func (c *Connection) Close() error {
-	return c.conn.Close()
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+		close(c.closed)
+	})
+	return err
 }
 
+// Done returns a channel that is closed once the connection is closed: by
+// Close, after the closing handshake or because reading or writing failed.
+func (c *Connection) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Write sends a complete message in a single frame.
 func (c *Connection) Write(messageType byte, message []byte) error {
-	frame := NewFrame(true, messageType, false, [4]byte{}, message)
-	_, err := c.conn.Write(frame.Bytes())
-	if err != nil {
-		log.Println(err)
+	return c.WriteContext(context.Background(), messageType, message)
+}
+
+// writeFrame writes a single frame to the wire. Nothing but the first close
+// frame can be written once a close frame was sent.
+func (c *Connection) writeFrame(ctx context.Context, frame *Frame) error {
+	if err := c.lock(ctx, c.writeLock); err != nil {
+		return err
+	}
+	defer c.unlock(c.writeLock)
+
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	payload := frame.Payload
+	if !c.isServer {
+		// Clients must mask every frame with a fresh key (RFC 6455 5.3).
+		// The caller's payload is left alone, the masked copy is pooled.
+		if err := newMaskKey(&frame.MaskKey); err != nil {
+			return err
+		}
+		frame.Mask = true
+		bp := getBuffer(len(payload))
+		defer putBuffer(bp)
+		copy(*bp, payload)
+		maskBytes(frame.MaskKey, 0, *bp)
+		payload = *bp
+	}
+
+	// Header and payload go out in one writev without being copied together.
+	c.writeVec = [2][]byte{frame.appendHeader(c.writeHeader[:0]), payload}
+	return c.writeVecLocked(ctx, frame.Opcode)
+}
+
+// writeVecLocked writes c.writeVec, which holds a frame of the given opcode.
+// The caller holds the write lock.
+func (c *Connection) writeVecLocked(ctx context.Context, opcode byte) error {
+	c.writeBufs = c.writeVec[:]
+	stop := c.interruptOnDone(ctx, true)
+	n, err := c.writeBufs.WriteTo(c.conn)
+	interrupted := stop()
+	c.writeVec = [2][]byte{}
+	if err == nil {
+		if opcode == OpClose {
+			c.closeSent = true
+		}
+		return nil
+	}
+
+	if n == 0 && (interrupted || isTimeout(err)) {
+		// Nothing went out, the connection is still in a clean state.
+		if interrupted {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	// The peer got part of a frame, the stream can't be continued.
+	if interrupted {
+		err = fmt.Errorf("conn: Write aborted in the middle of a frame: %w", ctx.Err())
 	}
+	log.Println(err)
+	c.writeErr = err
+	c.Close()
 	return err
 }
 
+// failWrites makes every later write return err and closes the connection.
+func (c *Connection) failWrites(err error) {
+	c.lock(context.Background(), c.writeLock)
+	if c.writeErr == nil {
+		c.writeErr = err
+	}
+	c.unlock(c.writeLock)
+	c.Close()
+}
+
+// Read returns the next text or binary message. Fragmented messages are
+// reassembled and reported with the opcode of their first frame. Control
+// frames are handled internally: pings are answered, pongs go to the pong
+// handler and a close frame is echoed before Read returns a *CloseError.
 func (c *Connection) Read() (messageType byte, message []byte, err error) {
-	frame, err := ReadFrame(c.br)
+	messageType, r, err := c.NextReader()
 	if err != nil {
 		return 0, nil, err
 	}
-	frame.MaskPayload()
-	return frame.Opcode, frame.Payload, nil
+
+	// A message in a single frame is read into a buffer of its size, as far
+	// as the claimed size can be trusted before any of it arrived.
+	size := int64(512)
+	if c.readFinal {
+		size = min(c.readRemaining, maxInitialPayload)
+	}
+	message, err = readAll(r, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, message, nil
+}
+
+// readAll is io.ReadAll starting with a buffer of the given size.
+func readAll(r io.Reader, size int64) ([]byte, error) {
+	b := make([]byte, 0, size)
+	for {
+		if len(b) == cap(b) {
+			// Look for the end before growing the buffer.
+			if _, err := r.Read(b[len(b):]); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return b, err
+			}
+			b = append(b, 0)[:len(b)]
+		}
+
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return b, err
+		}
+	}
+}
+
+// nextFrame reads frame headers until it finds a data frame, handling the
+// control frames in between. The payload of the returned frame is left in
+// the reader.
+func (c *Connection) nextFrame() (*Frame, error) {
+	for {
+		// A timeout before the next frame starts consumes nothing, so it
+		// doesn't fail the connection.
+		if _, err := c.br.Peek(1); err != nil {
+			if isTimeout(err) {
+				return nil, err
+			}
+			return nil, c.readFailed(err)
+		}
+
+		// The header is only peeked until it is complete, so a timeout
+		// inside it consumes nothing either.
+		frame := &c.readHeader
+		length, err := readFrameHeader(c.br, frame)
+		if isTimeout(err) {
+			return nil, err
+		}
+		if err == nil {
+			err = c.checkFrame(frame)
+		}
+		if err != nil {
+			var protoErr *protocolError
+			if errors.As(err, &protoErr) {
+				return nil, c.fail(CloseProtocolError, protoErr.reason)
+			}
+			return nil, c.readFailed(err)
+		}
+
+		if isControl(frame.Opcode) {
+			payload := c.controlBuf[:length]
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, c.readFailed(err)
+			}
+			frame.Payload = payload
+			frame.MaskPayload()
+
+			if err := c.handleControl(frame); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if frame.Opcode != OpContinuation {
+			c.readLength = 0
+		}
+		c.readLength += length
+		if c.readLimit > 0 && c.readLength > c.readLimit {
+			return nil, c.fail(CloseMessageTooBig, "Message exceeds the read limit")
+		}
+
+		c.readRemaining = length
+		c.readFinal = frame.Fin
+		c.readMasked = frame.Mask
+		c.readMaskKey = frame.MaskKey
+		c.readMaskPos = 0
+		return frame, nil
+	}
+}
+
+// checkFrame rejects frame headers that RFC 6455 forbids for this side of
+// the connection.
+func (c *Connection) checkFrame(frame *Frame) error {
+	switch {
+	case frame.Rsv2 || frame.Rsv3:
+		return &protocolError{"Unexpected RSV2 or RSV3 bit"}
+	case frame.Opcode > OpBinary && frame.Opcode < OpClose, frame.Opcode > OpPong:
+		return &protocolError{fmt.Sprintf("Reserved opcode %d", frame.Opcode)}
+	case isControl(frame.Opcode) && !frame.Fin:
+		return &protocolError{"Fragmented control frame"}
+	case isControl(frame.Opcode) && frame.Rsv1:
+		return &protocolError{"Compressed control frame"}
+	case frame.Rsv1 && (frame.Opcode == OpContinuation || c.decompressor == nil):
+		return &protocolError{"Unexpected RSV1 bit"}
+	// Clients must mask every frame, servers must not mask any (RFC 6455 5.1).
+	case c.isServer && !frame.Mask:
+		return &protocolError{"Unmasked frame from client"}
+	case !c.isServer && frame.Mask:
+		return &protocolError{"Masked frame from server"}
+	}
+	return nil
+}
+
+func (c *Connection) handleControl(frame *Frame) error {
+	switch frame.Opcode {
+	case OpPing:
+		// Once our close frame is out, pings go unanswered while we keep
+		// reading for the peer's close frame.
+		err := c.writeFrame(context.Background(), NewFrame(true, OpPong, false, [4]byte{}, frame.Payload))
+		if errors.Is(err, ErrCloseSent) {
+			return nil
+		}
+		return err
+	case OpPong:
+		c.keepalive.handlePong(frame.Payload)
+		if c.pongHandler != nil {
+			c.pongHandler(frame.Payload)
+		}
+		return nil
+	case OpClose:
+		closeErr, failure := parseClosePayload(frame.Payload)
+		if failure != nil {
+			return c.fail(uint16(failure.Code), failure.Reason)
+		}
+		c.closeRecvOnce.Do(func() {
+			close(c.closeReceived)
+		})
+
+		// The reply fails with ErrCloseSent when we started the handshake.
+		reply := NewFrame(true, OpClose, false, [4]byte{}, nil)
+		if closeErr.Code != CloseNoStatusReceived {
+			reply = NewCloseFrame(uint16(closeErr.Code), "")
+		}
+		c.writeFrame(context.Background(), reply)
+		c.Close()
+		return c.readFailed(closeErr)
+	}
+	return nil
+}
+
+// fail sends a close frame with the given code, drops the connection and
+// returns the reason as an error.
+func (c *Connection) fail(code uint16, reason string) error {
+	if c.readErr != nil {
+		return c.readErr
+	}
+	c.writeFrame(context.Background(), NewCloseFrame(code, reason))
+	c.Close()
+	return c.readFailed(fmt.Errorf("conn: %s", reason))
+}
+
+// readFailed records the first read error, all later reads return it, and
+// closes the connection: nothing can be read from it anymore. Timeouts that
+// leave the connection usable don't get here.
+func (c *Connection) readFailed(err error) error {
+	if c.readErr == nil {
+		if c.keepalive.timedOut.Load() {
+			// The connection was dropped because the peer stopped answering.
+			err = &CloseError{Code: CloseAbnormalClosure, Reason: "Keepalive timed out"}
+		}
+		c.readErr = err
+	}
+	c.Close()
+	return c.readErr
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x08 != 0
 }
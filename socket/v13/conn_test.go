@@ -0,0 +1,656 @@
+package v13
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer starts an HTTP server that upgrades every request and hands
+// the connection to handler. It returns the ws:// URL of the server.
+func newTestServer(t *testing.T, upgrader *Upgrader, handler func(c *Connection)) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		handler(c)
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialTest(t *testing.T, url string, opts *DialOptions) *Connection {
+	t.Helper()
+	c, err := Dial(context.Background(), url, opts)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	const writers = 8
+	const messages = 50
+
+	for _, compression := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compression=%v", compression), func(t *testing.T) {
+			url := newTestServer(t, &Upgrader{EnableCompression: true}, func(c *Connection) {
+				var wg sync.WaitGroup
+				for g := 0; g < writers; g++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < messages; i++ {
+							message := []byte(fmt.Sprintf("%d-%d-%s", g, i, strings.Repeat("x", i*100)))
+							if i%2 == 0 {
+								if err := c.Write(OpText, message); err != nil {
+									t.Errorf("write: %v", err)
+									return
+								}
+								continue
+							}
+
+							w, err := c.NextWriter(OpText)
+							if err != nil {
+								t.Errorf("next writer: %v", err)
+								return
+							}
+							for len(message) > 0 {
+								n := min(len(message), 1000)
+								w.Write(message[:n])
+								message = message[n:]
+							}
+							if err := w.Close(); err != nil {
+								t.Errorf("close writer: %v", err)
+								return
+							}
+						}
+					}()
+				}
+
+				// Pings from another goroutine interleave with the data messages.
+				for i := 0; i < messages; i++ {
+					if err := c.Write(OpPing, []byte("ping")); err != nil {
+						t.Errorf("ping: %v", err)
+					}
+				}
+				wg.Wait()
+				c.CloseWithReason(CloseNormalClosure, "")
+			})
+
+			c := dialTest(t, url, &DialOptions{EnableCompression: compression})
+			seen := make(map[string]bool)
+			for range writers * messages {
+				_, message, err := c.Read()
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+
+				parts := strings.SplitN(string(message), "-", 3)
+				if len(parts) != 3 {
+					t.Fatalf("corrupt message %.40q", message)
+				}
+				var i int
+				fmt.Sscan(parts[1], &i)
+				if parts[2] != strings.Repeat("x", i*100) {
+					t.Fatalf("corrupt padding in message %s-%s", parts[0], parts[1])
+				}
+				seen[parts[0]+"-"+parts[1]] = true
+			}
+
+			if len(seen) != writers*messages {
+				t.Fatalf("got %d distinct messages, want %d", len(seen), writers*messages)
+			}
+		})
+	}
+}
+
+func TestControlFrameDuringFragmentedWrite(t *testing.T) {
+	pinged := make(chan struct{})
+	pong := make(chan []byte, 1)
+	url := newTestServer(t, &Upgrader{}, func(c *Connection) {
+		c.SetPongHandler(func(appData []byte) {
+			pong <- bytes.Clone(appData)
+		})
+		go c.Read()
+
+		w, err := c.NextWriter(OpBinary)
+		if err != nil {
+			t.Errorf("next writer: %v", err)
+			return
+		}
+		w.Write(bytes.Repeat([]byte("a"), 3*defaultBufferSize))
+
+		// The message is still open, the ping must not wait for it.
+		if err := c.Write(OpPing, []byte("mid-message")); err != nil {
+			t.Errorf("ping: %v", err)
+		}
+		close(pinged)
+
+		select {
+		case payload := <-pong:
+			if string(payload) != "mid-message" {
+				t.Errorf("pong payload = %q", payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("no pong while the message was open")
+		}
+
+		w.Write(bytes.Repeat([]byte("b"), defaultBufferSize))
+		w.Close()
+	})
+
+	c := dialTest(t, url, nil)
+	op, message, err := c.Read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	<-pinged
+
+	want := append(bytes.Repeat([]byte("a"), 3*defaultBufferSize), bytes.Repeat([]byte("b"), defaultBufferSize)...)
+	if op != OpBinary || !bytes.Equal(message, want) {
+		t.Fatalf("got opcode %d and %d bytes, want binary message of %d bytes", op, len(message), len(want))
+	}
+}
+
+// pipePeer wraps the raw client end of rawClient.
+func pipePeer(peer net.Conn) *rawPeer {
+	return &rawPeer{conn: peer, br: bufio.NewReader(peer)}
+}
+
+type readResult struct {
+	op      byte
+	message string
+	err     error
+}
+
+// readResults reads n messages from c in the background.
+func readResults(c *Connection, n int) <-chan readResult {
+	results := make(chan readResult, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			op, message, err := c.Read()
+			results <- readResult{op, string(message), err}
+		}
+	}()
+	return results
+}
+
+func TestReadFragments(t *testing.T) {
+	c, peer := rawClient(t)
+	p := pipePeer(peer)
+	go func() {
+		p.send(false, OpText, []byte("hel"))
+		p.send(false, OpContinuation, []byte("l"))
+		p.send(true, OpPing, []byte("ping"))
+		p.send(true, OpContinuation, []byte("o"))
+		p.send(true, OpBinary, []byte("next"))
+	}()
+
+	results := readResults(c, 2)
+
+	// The ping between the fragments is answered.
+	if err := p.expect(OpPong, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []readResult{{OpText, "hello", nil}, {OpBinary, "next", nil}} {
+		if got := <-results; got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestReadInvalidFragments(t *testing.T) {
+	type frame struct {
+		fin     bool
+		opcode  byte
+		payload string
+	}
+	tests := []struct {
+		name   string
+		frames []frame
+	}{
+		{"continuation without start", []frame{{true, OpContinuation, "rest"}}},
+		{"text inside a message", []frame{{false, OpText, "a"}, {true, OpText, "b"}}},
+		{"binary inside a message", []frame{{false, OpText, "a"}, {true, OpBinary, "b"}}},
+	}
+	for _, tt := range tests {
+		c, peer := rawClient(t)
+		p := pipePeer(peer)
+		go func() {
+			for _, f := range tt.frames {
+				p.send(f.fin, f.opcode, []byte(f.payload))
+			}
+		}()
+		readErr := make(chan error, 1)
+		go func() {
+			_, _, err := c.Read()
+			readErr <- err
+		}()
+
+		if err := p.expectClose(CloseProtocolError); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if err := <-readErr; err == nil {
+			t.Errorf("%s: read succeeded", tt.name)
+		}
+	}
+}
+
+func TestControlFrames(t *testing.T) {
+	c, peer := rawClient(t)
+	p := pipePeer(peer)
+	pongs := make(chan string, 1)
+	c.SetPongHandler(func(appData []byte) { pongs <- string(appData) })
+	go func() {
+		p.send(true, OpPing, []byte("ping"))
+		p.send(true, OpPong, []byte("pong"))
+		p.send(true, OpText, []byte("hello"))
+		p.sendClose(CloseGoingAway, "bye")
+	}()
+
+	results := readResults(c, 2)
+
+	if err := p.expect(OpPong, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	// Only the data message reaches the application.
+	if got := <-results; got != (readResult{OpText, "hello", nil}) {
+		t.Errorf("got %+v, want the text message", got)
+	}
+	if got := <-pongs; got != "pong" {
+		t.Errorf("pong handler got %q", got)
+	}
+
+	// The close frame is echoed with its code before Read returns it.
+	if err := p.expectClose(CloseGoingAway); err != nil {
+		t.Fatal(err)
+	}
+	var closeErr *CloseError
+	if got := <-results; !errors.As(got.err, &closeErr) || *closeErr != (CloseError{CloseGoingAway, "bye"}) {
+		t.Errorf("got %+v, want close %d", got, CloseGoingAway)
+	}
+	if _, _, err := c.Read(); !errors.As(err, &closeErr) {
+		t.Errorf("read after the close got %v", err)
+	}
+}
+
+func TestEmptyCloseFrame(t *testing.T) {
+	c, peer := rawClient(t)
+	p := pipePeer(peer)
+	go p.send(true, OpClose, nil)
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := c.Read()
+		readErr <- err
+	}()
+
+	// CloseNoStatusReceived stands for an empty close frame.
+	if err := p.expectClose(CloseNoStatusReceived); err != nil {
+		t.Fatal(err)
+	}
+	var closeErr *CloseError
+	if err := <-readErr; !errors.As(err, &closeErr) || closeErr.Code != CloseNoStatusReceived {
+		t.Errorf("got %v, want close %d", err, CloseNoStatusReceived)
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	done := make(chan struct{})
+	url := newTestServer(t, &Upgrader{}, func(c *Connection) {
+		defer close(done)
+		for {
+			if _, _, err := c.Read(); err != nil {
+				return
+			}
+		}
+	})
+
+	c := dialTest(t, url, nil)
+	c.SetCloseTimeout(time.Second)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := c.Read(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			c.Write(OpText, []byte("hello"))
+		}()
+		go func() {
+			defer wg.Done()
+			c.CloseWithReason(CloseGoingAway, "bye")
+		}()
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Fatal("read returned no error after close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader was not released by close")
+	}
+	<-done
+
+	if err := c.Write(OpText, []byte("late")); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+}
+
+// TestPingWhileClosing checks that a ping arriving after our close frame
+// doesn't stop the reader before the peer's close frame.
+func TestPingWhileClosing(t *testing.T) {
+	c, peer := rawClient(t)
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := c.Read()
+		readErr <- err
+	}()
+
+	closed := make(chan time.Duration, 1)
+	go func() {
+		start := time.Now()
+		c.CloseWithReason(CloseNormalClosure, "bye")
+		closed <- time.Since(start)
+	}()
+
+	if frame, err := ReadFrame(bufio.NewReader(peer)); err != nil || frame.Opcode != OpClose {
+		t.Fatalf("got %v and %v, want a close frame", frame, err)
+	}
+	go func() {
+		peer.Write(maskedFrame(true, OpPing, []byte("ping")))
+		peer.Write(maskedFrame(true, OpClose, closePayload(CloseNormalClosure, "")))
+	}()
+
+	var closeErr *CloseError
+	if err := <-readErr; !errors.As(err, &closeErr) || closeErr.Code != CloseNormalClosure {
+		t.Fatalf("read: got %v, want the peer's close", err)
+	}
+	if elapsed := <-closed; elapsed >= defaultCloseTimeout {
+		t.Errorf("CloseWithReason took %v, waiting for the close timeout", elapsed)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	url := newTestServer(t, &Upgrader{}, func(c *Connection) {
+		for {
+			if _, _, err := c.Read(); err != nil {
+				return
+			}
+		}
+	})
+
+	c := dialTest(t, url, nil)
+	c.SetKeepalive(20*time.Millisecond, time.Second)
+	go c.Read()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().LastRTT == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no round-trip time measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := c.Stats(); stats.AverageRTT <= 0 || stats.AverageRTT > time.Second {
+		t.Fatalf("average RTT = %v", stats.AverageRTT)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	release := make(chan struct{})
+	url := newTestServer(t, &Upgrader{}, func(c *Connection) {
+		// Never read, so pings are not answered.
+		<-release
+	})
+	defer close(release)
+
+	c := dialTest(t, url, nil)
+	c.SetKeepalive(20*time.Millisecond, 50*time.Millisecond)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := c.Read()
+		readErr <- err
+	}()
+
+	select {
+	case err := <-readErr:
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != CloseAbnormalClosure {
+			t.Fatalf("read error = %v, want close code %d", err, CloseAbnormalClosure)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed after the keepalive timed out")
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	closeCode := make(chan int, 1)
+	url := newTestServer(t, &Upgrader{}, func(c *Connection) {
+		if err := c.Write(OpText, []byte("\xff")); err == nil {
+			t.Error("invalid text message was written")
+		}
+
+		// The rune is split between fragments and only its last byte is
+		// invalid.
+		ctx := context.Background()
+		c.writeFrame(ctx, NewFrame(false, OpText, false, [4]byte{}, []byte("ok \xe2")))
+		c.writeFrame(ctx, NewFrame(true, OpContinuation, false, [4]byte{}, []byte("\x82\x41")))
+
+		_, _, err := c.Read()
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) {
+			closeCode <- closeErr.Code
+		}
+		close(closeCode)
+	})
+
+	c := dialTest(t, url, nil)
+	if _, _, err := c.Read(); err == nil {
+		t.Fatal("invalid text message was read")
+	}
+	if code := <-closeCode; code != CloseInvalidFramePayload {
+		t.Fatalf("server got close code %d, want %d", code, CloseInvalidFramePayload)
+	}
+}
+
+func TestWriteInvalidFrames(t *testing.T) {
+	c, peer := rawClient(t)
+	tests := []struct {
+		name        string
+		messageType byte
+		message     []byte
+	}{
+		{"long ping", OpPing, make([]byte, maxControlPayload+1)},
+		{"long pong", OpPong, make([]byte, maxControlPayload+1)},
+		{"close", OpClose, closePayload(CloseNormalClosure, "")},
+		{"continuation", OpContinuation, []byte("rest")},
+		{"reserved data opcode", 3, []byte("data")},
+		{"reserved data opcode", 7, []byte("data")},
+		{"reserved control opcode", 11, nil},
+	}
+	for _, tt := range tests {
+		if err := c.Write(tt.messageType, tt.message); err == nil {
+			t.Errorf("%s: written", tt.name)
+		}
+	}
+
+	// Nothing went out and the connection is still open.
+	go func() {
+		c.Write(OpPing, make([]byte, maxControlPayload))
+		c.Write(OpText, []byte("hello"))
+	}()
+	br := bufio.NewReader(peer)
+	for _, want := range []byte{OpPing, OpText} {
+		frame, err := ReadFrame(br)
+		if err != nil || frame.Opcode != want {
+			t.Fatalf("got %+v and %v, want opcode %d", frame, err, want)
+		}
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	c, peer := rawClient(t)
+	c.SetReadLimit(10)
+	p := pipePeer(peer)
+	go func() {
+		p.send(true, OpText, []byte("0123456789"))
+		p.send(false, OpBinary, []byte("01234"))
+		p.send(true, OpContinuation, []byte("56789"))
+	}()
+	for i := 0; i < 2; i++ {
+		if _, message, err := c.Read(); err != nil || string(message) != "0123456789" {
+			t.Fatalf("got %q and %v for a message at the limit", message, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		send func(p *rawPeer)
+	}{
+		{"frame", func(p *rawPeer) { p.send(true, OpText, []byte("01234567890")) }},
+		{"fragments", func(p *rawPeer) {
+			p.send(false, OpText, []byte("012345"))
+			p.send(true, OpContinuation, []byte("67890"))
+		}},
+		// The claimed length fails the connection before any payload.
+		{"claimed length", func(p *rawPeer) { p.conn.Write([]byte{0x82, 0xff, 0, 0, 0, 1, 0, 0, 0, 0, 1, 2, 3, 4}) }},
+	}
+	for _, tt := range tests {
+		c, peer := rawClient(t)
+		c.SetReadLimit(10)
+		p := pipePeer(peer)
+		go tt.send(p)
+		readErr := make(chan error, 1)
+		go func() {
+			_, _, err := c.Read()
+			readErr <- err
+		}()
+
+		if err := p.expectClose(CloseMessageTooBig); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if err := <-readErr; err == nil {
+			t.Errorf("%s: read succeeded", tt.name)
+		}
+	}
+}
+
+func TestCheckFrame(t *testing.T) {
+	masked := func(f *Frame) *Frame {
+		f.Mask = true
+		return f
+	}
+	text := func() *Frame { return NewFrame(true, OpText, false, [4]byte{}, nil) }
+	tests := []struct {
+		name   string
+		server bool
+		frame  *Frame
+		ok     bool
+	}{
+		{"masked frame to a server", true, masked(text()), true},
+		{"unmasked frame to a server", true, text(), false},
+		{"unmasked frame to a client", false, text(), true},
+		{"masked frame to a client", false, masked(text()), false},
+		{"RSV1 without compression", false, withRsv(text(), 4), false},
+		{"RSV2", false, withRsv(text(), 2), false},
+		{"RSV3", false, withRsv(text(), 1), false},
+		{"reserved data opcode 3", false, NewFrame(true, 3, false, [4]byte{}, nil), false},
+		{"reserved data opcode 7", false, NewFrame(true, 7, false, [4]byte{}, nil), false},
+		{"reserved control opcode 11", false, NewFrame(true, 11, false, [4]byte{}, nil), false},
+		{"reserved control opcode 15", false, NewFrame(true, 15, false, [4]byte{}, nil), false},
+		{"fragmented ping", false, NewFrame(false, OpPing, false, [4]byte{}, nil), false},
+		{"fragmented close", false, NewFrame(false, OpClose, false, [4]byte{}, nil), false},
+	}
+	for _, tt := range tests {
+		c := &Connection{isServer: tt.server}
+		if err := c.checkFrame(tt.frame); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// TestStrictFrames checks that invalid frames fail the connection with
+// CloseProtocolError.
+func TestStrictFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+	}{
+		{"unmasked", NewFrame(true, OpText, false, [4]byte{}, []byte("hello"))},
+		{"RSV2", withRsv(clientFrame(true, OpText, []byte("hello")), 2)},
+		{"reserved opcode", clientFrame(true, 3, []byte("hello"))},
+		{"fragmented ping", clientFrame(false, OpPing, []byte("ping"))},
+	}
+	for _, tt := range tests {
+		c, peer := rawClient(t)
+		p := pipePeer(peer)
+		go p.sendFrame(tt.frame)
+		readErr := make(chan error, 1)
+		go func() {
+			_, _, err := c.Read()
+			readErr <- err
+		}()
+
+		if err := p.expectClose(CloseProtocolError); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if err := <-readErr; err == nil {
+			t.Errorf("%s: read succeeded", tt.name)
+		}
+	}
+}
+
+// TestReadClaimedLength reads a frame claiming a huge payload without a read
+// limit: the buffer must grow with the data that arrives, not with the
+// length in the header.
+func TestReadClaimedLength(t *testing.T) {
+	a, b := net.Pipe()
+	c := NewConnection(a)
+	defer c.Close()
+
+	header := []byte{0x82, 0x80 | 127, 0, 0, 1, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+	go func() {
+		b.Write(header)
+		b.Write(make([]byte, 100))
+		b.Close()
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, _, err := c.Read(); err == nil {
+		t.Fatal("read a message that was cut off")
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes for 100 bytes of payload", allocated)
+	}
+}
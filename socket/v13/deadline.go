@@ -0,0 +1,160 @@
+package v13
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// aLongTimeAgo is a deadline in the past, setting it aborts blocked I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// SetReadDeadline sets the deadline for reading from the peer. A read that
+// times out leaves the connection usable, the rest of a message that was
+// partly read is discarded by the next Read. Only a timeout inside a control
+// frame or a compressed message, which can't be resumed, closes the
+// connection.
+func (c *Connection) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writing frames. A write that times
+// out before any byte of its frame went out leaves the connection usable; a
+// frame that was cut off closes the connection.
+func (c *Connection) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
+
+// ReadContext is Read that gives up when ctx is done. Cancelling leaves the
+// connection usable as a read deadline does: a message that was only partly
+// received is discarded by the next read.
+func (c *Connection) ReadContext(ctx context.Context) (messageType byte, message []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	stop := c.interruptOnDone(ctx, false)
+	messageType, message, err = c.Read()
+	if stop() && err != nil {
+		if c.readErr != nil {
+			return 0, nil, fmt.Errorf("conn: Read aborted in the middle of a frame: %w", ctx.Err())
+		}
+		return 0, nil, ctx.Err()
+	}
+	return messageType, message, err
+}
+
+// WriteContext is Write that gives up when ctx is done. A message is always
+// sent as a single frame here, so cancelling never leaves a partial message
+// behind; cancelling in the middle of the frame closes the connection.
+// Besides text and binary messages, pings and pongs of up to 125 bytes can
+// be written; close frames are sent with CloseWithReason.
+func (c *Connection) WriteContext(ctx context.Context, messageType byte, message []byte) error {
+	switch messageType {
+	case OpText, OpBinary:
+	case OpPing, OpPong:
+		if len(message) > maxControlPayload {
+			return fmt.Errorf("conn: Control frame payload is longer than %d bytes", maxControlPayload)
+		}
+		return c.writeFrame(ctx, NewFrame(true, messageType, false, [4]byte{}, message))
+	case OpClose:
+		return fmt.Errorf("conn: Close frames are sent with CloseWithReason")
+	default:
+		return fmt.Errorf("conn: Invalid message type %d", messageType)
+	}
+
+	if messageType == OpText && !utf8.Valid(message) {
+		return fmt.Errorf("conn: Message is not valid UTF-8")
+	}
+
+	if err := c.lock(ctx, c.msgLock); err != nil {
+		return err
+	}
+	defer c.unlock(c.msgLock)
+
+	frame := NewFrame(true, messageType, false, [4]byte{}, message)
+	compressed := c.writeCompress && c.compressor != nil
+	if compressed {
+		bp := getBuffer(0)
+		defer putBuffer(bp)
+		payload, err := c.compressor.compress((*bp)[:0], message)
+		*bp = payload[:0]
+		if err != nil {
+			return err
+		}
+		frame.Payload = payload
+		frame.Rsv1 = true
+	}
+
+	err := c.writeFrame(ctx, frame)
+	if compressed && err != nil {
+		// The peer never saw this message, so it can't be part of the
+		// compression context of the next one.
+		c.compressor.reset()
+	}
+	return err
+}
+
+// interruptOnDone moves the read or write deadline into the past once ctx is
+// done. The returned function stops watching ctx; if ctx interrupted the I/O,
+// it restores the deadline and reports true.
+func (c *Connection) interruptOnDone(ctx context.Context, write bool) func() bool {
+	if ctx.Done() == nil {
+		return notInterrupted
+	}
+
+	setDeadline, deadline := c.conn.SetReadDeadline, &c.readDeadline
+	if write {
+		setDeadline, deadline = c.conn.SetWriteDeadline, &c.writeDeadline
+	}
+
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		c.deadlineMu.Lock()
+		defer c.deadlineMu.Unlock()
+		setDeadline(aLongTimeAgo)
+		close(fired)
+	})
+
+	return func() bool {
+		if stop() {
+			return false
+		}
+		<-fired
+		c.deadlineMu.Lock()
+		defer c.deadlineMu.Unlock()
+		setDeadline(*deadline)
+		return true
+	}
+}
+
+func notInterrupted() bool {
+	return false
+}
+
+// lock acquires a channel lock unless ctx is done first.
+func (c *Connection) lock(ctx context.Context, l chan struct{}) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Connection) unlock(l chan struct{}) {
+	<-l
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
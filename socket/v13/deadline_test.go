@@ -0,0 +1,211 @@
+package v13
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// rawClient returns a server connection and the raw client end of its pipe.
+func rawClient(t *testing.T) (*Connection, net.Conn) {
+	a, b := net.Pipe()
+	c := newConnection(a, bufio.NewReader(a), defaultBufferSize, true)
+	t.Cleanup(func() {
+		c.Close()
+		b.Close()
+	})
+	return c, b
+}
+
+// maskedFrame encodes a frame as a client sends it.
+func maskedFrame(fin bool, opcode byte, payload []byte) []byte {
+	f := NewFrame(fin, opcode, true, [4]byte{1, 2, 3, 4}, bytes.Clone(payload))
+	f.MaskPayload()
+	return f.Bytes()
+}
+
+func isClosed(c *Connection) bool {
+	select {
+	case <-c.Done():
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+// cancelSoon returns a context that is cancelled once the I/O under test had
+// time to block.
+func cancelSoon(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	return ctx
+}
+
+func TestReadDeadline(t *testing.T) {
+	t.Run("before a frame", func(t *testing.T) {
+		c, peer := rawClient(t)
+		c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, err := c.Read(); !isTimeout(err) {
+			t.Fatalf("got %v, want a timeout", err)
+		}
+
+		go peer.Write(maskedFrame(true, OpText, []byte("hello")))
+		c.SetReadDeadline(time.Time{})
+		if _, message, err := c.Read(); err != nil || string(message) != "hello" {
+			t.Fatalf("got %q and %v after the timeout", message, err)
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		c, peer := rawClient(t)
+		frame := maskedFrame(true, OpText, []byte("hello"))
+
+		go peer.Write(frame[:3])
+		c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, err := c.Read(); !isTimeout(err) {
+			t.Fatalf("got %v, want a timeout", err)
+		}
+
+		// Nothing of the header was consumed.
+		go peer.Write(frame[3:])
+		c.SetReadDeadline(time.Time{})
+		if _, message, err := c.Read(); err != nil || string(message) != "hello" {
+			t.Fatalf("got %q and %v after the timeout", message, err)
+		}
+	})
+
+	t.Run("control payload", func(t *testing.T) {
+		c, peer := rawClient(t)
+		frame := maskedFrame(true, OpPing, []byte("ping"))
+
+		go peer.Write(frame[:len(frame)-2])
+		c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, err := c.Read(); !isTimeout(err) {
+			t.Fatalf("got %v, want a timeout", err)
+		}
+		// The ping was cut off, the connection can't be read anymore and
+		// must not linger.
+		if !isClosed(c) {
+			t.Fatal("connection was not closed")
+		}
+	})
+}
+
+func TestReadContext(t *testing.T) {
+	t.Run("before a message", func(t *testing.T) {
+		c, peer := rawClient(t)
+		if _, _, err := c.ReadContext(cancelSoon(t)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+
+		go peer.Write(maskedFrame(true, OpText, []byte("hello")))
+		if _, message, err := c.Read(); err != nil || string(message) != "hello" {
+			t.Fatalf("got %q and %v after cancelling", message, err)
+		}
+	})
+
+	t.Run("inside a message", func(t *testing.T) {
+		c, peer := rawClient(t)
+		frame := maskedFrame(true, OpBinary, make([]byte, 100))
+
+		go peer.Write(frame[:50])
+		if _, _, err := c.ReadContext(cancelSoon(t)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+
+		// The rest of the message is discarded by the next read.
+		go func() {
+			peer.Write(frame[50:])
+			peer.Write(maskedFrame(true, OpText, []byte("next")))
+		}()
+		if _, message, err := c.Read(); err != nil || string(message) != "next" {
+			t.Fatalf("got %q and %v after cancelling", message, err)
+		}
+	})
+
+	t.Run("inside a control frame", func(t *testing.T) {
+		c, peer := rawClient(t)
+		frame := maskedFrame(true, OpPing, []byte("ping"))
+
+		go peer.Write(frame[:len(frame)-2])
+		if _, _, err := c.ReadContext(cancelSoon(t)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+		if !isClosed(c) {
+			t.Fatal("connection was not closed")
+		}
+	})
+}
+
+// TestWriteContext checks that cancelled writes never leave part of a frame
+// on the wire: either nothing went out and the connection is usable, or it
+// is closed.
+func TestWriteContext(t *testing.T) {
+	t.Run("before any byte", func(t *testing.T) {
+		c, peer := rawClient(t)
+		if err := c.WriteContext(cancelSoon(t), OpText, []byte("first")); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+
+		go c.Write(OpText, []byte("second"))
+		frame, err := ReadFrame(bufio.NewReader(peer))
+		if err != nil || string(frame.Payload) != "second" {
+			t.Fatalf("got %+v and %v after cancelling", frame, err)
+		}
+	})
+
+	t.Run("inside a frame", func(t *testing.T) {
+		c, peer := rawClient(t)
+		go io.ReadFull(peer, make([]byte, 10))
+		if err := c.WriteContext(cancelSoon(t), OpBinary, make([]byte, 1<<16)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+		if !isClosed(c) {
+			t.Fatal("connection was not closed")
+		}
+		if err := c.Write(OpText, []byte("next")); err == nil {
+			t.Fatal("wrote after a frame was cut off")
+		}
+	})
+
+	t.Run("waiting for another message", func(t *testing.T) {
+		c, peer := rawClient(t)
+		w, err := c.NextWriter(OpText)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WriteContext(cancelSoon(t), OpText, []byte("queued")); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+
+		go func() {
+			w.Write([]byte("streamed"))
+			w.Close()
+		}()
+		frame, err := ReadFrame(bufio.NewReader(peer))
+		if err != nil || string(frame.Payload) != "streamed" {
+			t.Fatalf("got %+v and %v after cancelling", frame, err)
+		}
+	})
+}
+
+func TestWriteDeadline(t *testing.T) {
+	c, peer := rawClient(t)
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := c.Write(OpText, []byte("first")); !isTimeout(err) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	c.SetWriteDeadline(time.Time{})
+	go c.Write(OpText, []byte("second"))
+	frame, err := ReadFrame(bufio.NewReader(peer))
+	if err != nil || string(frame.Payload) != "second" {
+		t.Fatalf("got %+v and %v after the timeout", frame, err)
+	}
+}
@@ -1,11 +1,33 @@
 package v13
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"time"
 )
 
 func Demo() {
+	go func() {
+		time.Sleep(time.Second)
+		client, err := Dial(context.Background(), "ws://127.0.0.1:6969/ws", nil)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		_, message, err := client.Read()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		log.Printf("client: Received message: '%s'", message)
+
+		if err := client.Write(OpText, []byte("hello from client")); err != nil {
+			log.Println(err)
+		}
+	}()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /ws", func(w http.ResponseWriter, r *http.Request) {
 		conn, err := Upgrade(w, r)
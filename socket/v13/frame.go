@@ -2,9 +2,10 @@ package v13
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
+	"slices"
 )
 
 const (
@@ -33,8 +34,30 @@ const (
 	CloseTLSHandshake        = 1015
 )
 
+const (
+	// maxInitialPayload caps the buffer allocated up front for a payload.
+	maxInitialPayload = 1 << 16
+	// maxHeaderSize is the size of the longest frame header: two bytes, an
+	// eight byte length and the mask key.
+	maxHeaderSize = 14
+)
+
+// protocolError is a violation of RFC 6455 found while parsing a frame.
+type protocolError struct {
+	reason string
+}
+
+func (e *protocolError) Error() string {
+	return "frame: " + e.reason
+}
+
 type Frame struct {
-	Fin     bool
+	Fin bool
+	// Rsv1 marks the first frame of a compressed message (RFC 7692).
+	Rsv1 bool
+	// Rsv2 and Rsv3 are not used by any supported extension.
+	Rsv2    bool
+	Rsv3    bool
 	Opcode  byte
 	Mask    bool
 	MaskKey [4]byte
@@ -56,75 +79,115 @@ func NewTextFrame(payload []byte) *Frame {
 }
 
 func NewCloseFrame(code uint16, reason string) *Frame {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, code)
-	buf.Write([]byte(reason))
-	return NewFrame(true, OpClose, false, [4]byte{}, buf.Bytes())
+	payload := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(reason)), code)
+	payload = append(payload, reason...)
+	return NewFrame(true, OpClose, false, [4]byte{}, payload)
 }
 
 func ReadFrame(br *bufio.Reader) (*Frame, error) {
 	frame := &Frame{}
-	controlByte, err := readByte(br)
+	length, err := readFrameHeader(br, frame)
 	if err != nil {
 		return nil, err
 	}
-	frame.Fin = controlByte>>7 == 1
-	frame.Opcode = controlByte & 0x0f
 
-	lengthByte, err := readByte(br)
+	payloadBuf, err := readPayload(br, length)
 	if err != nil {
 		return nil, err
 	}
-	mask := lengthByte>>7 == 1
-	frame.Mask = mask
-	payloadLengthByte := lengthByte & 0x7f
-	length := int(payloadLengthByte)
-	switch payloadLengthByte {
-	case 126:
-		lengthValueBuf, err := readBytes(br, 2)
-		if err != nil {
-			return nil, err
-		}
-		length = int(binary.BigEndian.Uint16(lengthValueBuf))
-	case 127:
-		lengthValueBuf, err := readBytes(br, 8)
-		if err != nil {
-			return nil, err
+	frame.Payload = payloadBuf
+
+	return frame, nil
+}
+
+// readPayload grows the buffer as data arrives, so a forged length can't make
+// it allocate more than the peer actually sends.
+func readPayload(br *bufio.Reader, length int64) ([]byte, error) {
+	buf := make([]byte, 0, min(length, maxInitialPayload))
+	for int64(len(buf)) < length {
+		if len(buf) == cap(buf) {
+			buf = slices.Grow(buf, int(min(length-int64(len(buf)), int64(len(buf)))))
 		}
-		length = int(binary.BigEndian.Uint64(lengthValueBuf))
-	}
 
-	if mask {
-		maskBuf, err := readBytes(br, 4)
+		n, err := io.ReadFull(br, buf[len(buf):min(int64(cap(buf)), length)])
+		buf = buf[:len(buf)+n]
 		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
 			return nil, err
 		}
-		frame.MaskKey = [4]byte(maskBuf)
 	}
+	return buf, nil
+}
 
-	payloadBuf, err := readBytes(br, length)
+// readFrameHeader reads a frame up to its payload into frame and returns the
+// payload length, so the payload can be streamed from br. The header is
+// parsed in br's buffer and consumed only once it is complete.
+func readFrameHeader(br *bufio.Reader, frame *Frame) (int64, error) {
+	b, err := peekFull(br, 2)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	frame.Payload = payloadBuf
 
-	return frame, nil
-}
+	size := 2
+	switch b[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if b[1]&0x80 != 0 {
+		size += 4
+	}
+	if b, err = peekFull(br, size); err != nil {
+		return 0, err
+	}
 
-func readBytes(br *bufio.Reader, n int) ([]byte, error) {
-	buf := make([]byte, n)
-	if _, err := br.Read(buf); err != nil && err != io.EOF {
-		return nil, err
+	*frame = Frame{
+		Fin:    b[0]&0x80 != 0,
+		Rsv1:   b[0]&0x40 != 0,
+		Rsv2:   b[0]&0x20 != 0,
+		Rsv3:   b[0]&0x10 != 0,
+		Opcode: b[0] & 0x0f,
+		Mask:   b[1]&0x80 != 0,
 	}
-	return buf, nil
+
+	length := int64(b[1] & 0x7f)
+	pos := 2
+	switch length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(b[pos:]))
+		pos += 2
+	case 127:
+		length64 := binary.BigEndian.Uint64(b[pos:])
+		if length64 > math.MaxInt64 {
+			return 0, &protocolError{"Most significant bit of payload length is set"}
+		}
+		length = int64(length64)
+		pos += 8
+	}
+
+	if frame.Mask {
+		frame.MaskKey = [4]byte(b[pos:])
+	}
+	br.Discard(size)
+
+	if isControl(frame.Opcode) && length > maxControlPayload {
+		return 0, &protocolError{"Control frame payload is longer than 125 bytes"}
+	}
+
+	return length, nil
 }
 
-func readByte(br *bufio.Reader) (byte, error) {
-	b, err := readBytes(br, 1)
-	if err != nil {
-		return 0, err
+// peekFull returns the next n bytes of br without consuming them. Input that
+// ends after the first of them is reported as io.ErrUnexpectedEOF.
+func peekFull(br *bufio.Reader, n int) ([]byte, error) {
+	b, err := br.Peek(n)
+	if err == io.EOF && len(b) > 0 {
+		err = io.ErrUnexpectedEOF
 	}
-	return b[0], nil
+	return b, err
 }
 
 func (f Frame) MaskPayload() {
@@ -136,54 +199,81 @@ func (f Frame) MaskPayload() {
 		return
 	}
 
-	maskKey := f.MaskKey
-	payload := f.Payload
-	for i := 0; i < len(payload); i++ {
-		payload[i] ^= maskKey[i%4]
+	maskBytes(f.MaskKey, 0, f.Payload)
+}
+
+// maskBytes masks b in place as if it started at offset pos of the payload
+// and returns the offset following b. It is used both to mask and to unmask.
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	if len(b) >= 8 {
+		// Rotate the key to start at pos and repeat it to fill a word. A word
+		// is a multiple of the key length, so the key stays aligned.
+		var k [8]byte
+		for i := range k {
+			k[i] = key[(pos+i)%4]
+		}
+		word := binary.LittleEndian.Uint64(k[:])
+
+		for len(b) >= 32 {
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^word)
+			binary.LittleEndian.PutUint64(b[8:], binary.LittleEndian.Uint64(b[8:])^word)
+			binary.LittleEndian.PutUint64(b[16:], binary.LittleEndian.Uint64(b[16:])^word)
+			binary.LittleEndian.PutUint64(b[24:], binary.LittleEndian.Uint64(b[24:])^word)
+			b = b[32:]
+		}
+		for len(b) >= 8 {
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^word)
+			b = b[8:]
+		}
+	}
+
+	for i := range b {
+		b[i] ^= key[(pos+i)%4]
 	}
+	return (pos + len(b)) % 4
 }
 
 func (f Frame) Bytes() []byte {
-	buf := new(bytes.Buffer)
+	b := make([]byte, 0, maxHeaderSize+len(f.Payload))
+	b = f.appendHeader(b)
+	return append(b, f.Payload...)
+}
 
-	fin := byte(0)
+// appendHeader appends the encoded frame header to b.
+func (f *Frame) appendHeader(b []byte) []byte {
+	controlByte := f.Opcode & 0x0f
 	if f.Fin {
-		fin = 1
+		controlByte |= 0x80
+	}
+	if f.Rsv1 {
+		controlByte |= 0x40
+	}
+	if f.Rsv2 {
+		controlByte |= 0x20
+	}
+	if f.Rsv3 {
+		controlByte |= 0x10
 	}
-	controlByte := fin << 7
-	controlByte |= 0 << 6 // rsv1
-	controlByte |= 0 << 5 // rsv2
-	controlByte |= 0 << 4 // rsv3
-	controlByte |= f.Opcode & 0x0f
-	buf.WriteByte(controlByte)
 
-	payloadLength := len(f.Payload)
 	lengthByte := byte(0)
-	if payloadLength < 126 {
-		lengthByte = byte(payloadLength)
-	} else if payloadLength < 0xffff {
-		lengthByte = 126
-	} else {
-		lengthByte = 127
-	}
-	mask := byte(0)
 	if f.Mask {
-		mask = 1
+		lengthByte = 0x80
 	}
-	lengthByte |= mask << 7
-	buf.WriteByte(lengthByte)
 
-	if payloadLength >= 126 && payloadLength < 0xffff {
-		binary.Write(buf, binary.BigEndian, uint16(payloadLength))
-	} else if payloadLength >= 0xffff {
-		binary.Write(buf, binary.BigEndian, uint64(payloadLength))
+	payloadLength := len(f.Payload)
+	switch {
+	case payloadLength < 126:
+		b = append(b, controlByte, lengthByte|byte(payloadLength))
+	case payloadLength <= 0xffff:
+		b = append(b, controlByte, lengthByte|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(payloadLength))
+	default:
+		b = append(b, controlByte, lengthByte|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(payloadLength))
 	}
 
 	if f.Mask {
-		buf.Write(f.MaskKey[:])
+		b = append(b, f.MaskKey[:]...)
 	}
-
-	buf.Write(f.Payload)
-
-	return buf.Bytes()
+	return b
 }
@@ -0,0 +1,328 @@
+package v13
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Walter-Sparrow/go-socket/socket/internal/chaos"
+)
+
+var chaosModes = []struct {
+	name string
+	wrap func(net.Conn) net.Conn
+}{
+	{"one-byte", func(c net.Conn) net.Conn { return chaos.OneByte(c) }},
+	{"random", func(c net.Conn) net.Conn { return chaos.Random(c, 1, 37) }},
+}
+
+var chaosSizes = []int{0, 1, 125, 126, 127, 65535, 65536, 200000}
+
+func TestReadFrameChaos(t *testing.T) {
+	for _, mode := range chaosModes {
+		t.Run(mode.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+
+			var frames []*Frame
+			for i, size := range chaosSizes {
+				payload := bytes.Repeat([]byte{byte(i + 1)}, size)
+				frames = append(frames, NewFrame(true, OpBinary, i%2 == 0, [4]byte{1, 2, 3, 4}, payload))
+			}
+			go func() {
+				for _, f := range frames {
+					masked := *f
+					masked.Payload = bytes.Clone(f.Payload)
+					masked.MaskPayload()
+					a.Write(masked.Bytes())
+				}
+			}()
+
+			br := bufio.NewReader(mode.wrap(b))
+			for _, want := range frames {
+				f, err := ReadFrame(br)
+				if err != nil {
+					t.Fatalf("read frame of %d bytes: %v", len(want.Payload), err)
+				}
+				f.MaskPayload()
+				if f.Mask != want.Mask || !bytes.Equal(f.Payload, want.Payload) {
+					t.Fatalf("frame of %d bytes came back as %d bytes", len(want.Payload), len(f.Payload))
+				}
+			}
+		})
+	}
+}
+
+func TestReadFrameUnexpectedEOF(t *testing.T) {
+	encoded := NewFrame(true, OpBinary, true, [4]byte{1, 2, 3, 4}, make([]byte, 300)).Bytes()
+	for _, n := range []int{1, 3, 7, 100} {
+		if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(encoded[:n]))); err != io.ErrUnexpectedEOF {
+			t.Errorf("frame cut off after %d bytes: got %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(nil))); err != io.EOF {
+		t.Errorf("no input: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadFrameLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		length int64
+		ok     bool
+	}{
+		{"7-bit", []byte{0x82, 125}, 125, true},
+		{"16-bit", []byte{0x82, 126, 0x01, 0x00}, 256, true},
+		{"64-bit", []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}, 1 << 16, true},
+		{"64-bit with the top bit set", []byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0}, 0, false},
+		{"largest 64-bit", []byte{0x82, 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1<<63 - 1, true},
+		{"ping of 125 bytes", []byte{0x89, 125}, 125, true},
+		{"ping of 126 bytes", []byte{0x89, 126, 0x00, 126}, 0, false},
+		{"close of 126 bytes", []byte{0x88, 126, 0x00, 126}, 0, false},
+	}
+	for _, tt := range tests {
+		var frame Frame
+		length, err := readFrameHeader(bufio.NewReader(bytes.NewReader(tt.header)), &frame)
+		if (err == nil) != tt.ok || length != tt.length {
+			t.Errorf("%s: got length %d and %v, want %d and ok %v", tt.name, length, err, tt.length, tt.ok)
+		}
+	}
+}
+
+func TestConnectionChaos(t *testing.T) {
+	text := strings.Repeat("Hello-µ@ßöäüàá-UTF-8!! κόσμε \U0001F600 ", 3000)
+	for _, mode := range chaosModes {
+		for _, compression := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/compression=%v", mode.name, compression), func(t *testing.T) {
+				a, b := net.Pipe()
+				client := newConnection(a, bufio.NewReader(a), defaultBufferSize, false)
+				conn := mode.wrap(b)
+				server := newConnection(conn, bufio.NewReaderSize(conn, defaultBufferSize), defaultBufferSize, true)
+				if compression {
+					client.setCompression(&compressionParams{})
+					server.setCompression(&compressionParams{})
+				}
+				defer client.Close()
+				defer server.Close()
+
+				go func() {
+					for _, size := range chaosSizes {
+						client.Write(OpBinary, bytes.Repeat([]byte{0x2a}, size))
+					}
+					w, _ := client.NextWriter(OpText)
+					io.Copy(w, strings.NewReader(text))
+					w.Close()
+				}()
+
+				for _, size := range chaosSizes {
+					op, message, err := server.Read()
+					if err != nil {
+						t.Fatalf("read message of %d bytes: %v", size, err)
+					}
+					if op != OpBinary || !bytes.Equal(message, bytes.Repeat([]byte{0x2a}, size)) {
+						t.Fatalf("message of %d bytes came back as %d bytes", size, len(message))
+					}
+				}
+				op, message, err := server.Read()
+				if err != nil || op != OpText || string(message) != text {
+					t.Fatalf("text message: got %d bytes and %v", len(message), err)
+				}
+			})
+		}
+	}
+}
+
+func TestHandshakeChaos(t *testing.T) {
+	upgrader := &Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		c.Write(OpText, []byte("hello"))
+		c.Read()
+	}))
+	defer srv.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http"))
+
+	for _, mode := range chaosModes {
+		t.Run(mode.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn = mode.wrap(conn)
+
+			br := bufio.NewReader(conn)
+			opts := &DialOptions{EnableCompression: true}
+			_, compression, err := clientHandshake(conn, br, u, opts)
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+
+			c := newConnection(conn, br, defaultBufferSize, false)
+			c.setCompression(compression)
+			defer c.Close()
+			if _, message, err := c.Read(); err != nil || string(message) != "hello" {
+				t.Fatalf("got %q and %v, want hello", message, err)
+			}
+			c.CloseWithReason(CloseNormalClosure, "")
+		})
+	}
+}
+
+// loopConn serves the same bytes over and over and discards what is written,
+// so benchmarks measure the codec rather than the network.
+type loopConn struct {
+	net.Conn
+	data []byte
+	pos  int
+}
+
+func (c *loopConn) Read(p []byte) (int, error) {
+	n := copy(p, c.data[c.pos:])
+	c.pos = (c.pos + n) % len(c.data)
+	return n, nil
+}
+
+func (c *loopConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *loopConn) Close() error                       { return nil }
+func (c *loopConn) SetDeadline(t time.Time) error      { return nil }
+func (c *loopConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *loopConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var benchmarkSizes = []int{16, 1024, 64 * 1024}
+
+func BenchmarkFrameBytes(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			frame := NewFrame(true, OpBinary, false, [4]byte{}, make([]byte, size))
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				frame.Bytes()
+			}
+		})
+	}
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			frame := NewFrame(true, OpBinary, true, [4]byte{1, 2, 3, 4}, make([]byte, size))
+			br := bufio.NewReader(&loopConn{data: frame.Bytes()})
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := ReadFrame(br); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	for _, isServer := range []bool{true, false} {
+		for _, size := range benchmarkSizes {
+			b.Run(fmt.Sprintf("server=%v/%d", isServer, size), func(b *testing.B) {
+				conn := &loopConn{}
+				c := newConnection(conn, bufio.NewReader(conn), defaultBufferSize, isServer)
+				message := make([]byte, size)
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if err := c.Write(OpBinary, message); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, isServer := range []bool{true, false} {
+		for _, size := range benchmarkSizes {
+			b.Run(fmt.Sprintf("server=%v/%d", isServer, size), func(b *testing.B) {
+				// Servers read masked frames from clients.
+				frame := NewFrame(true, OpBinary, isServer, [4]byte{1, 2, 3, 4}, bytes.Repeat([]byte{0x2a}, size))
+				frame.MaskPayload()
+				conn := &loopConn{data: frame.Bytes()}
+				c := newConnection(conn, bufio.NewReaderSize(conn, defaultBufferSize), defaultBufferSize, isServer)
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if _, _, err := c.Read(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// maskBytesBytewise is the reference masking maskBytes must agree with.
+func maskBytesBytewise(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[(pos+i)%4]
+	}
+	return (pos + len(b)) % 4
+}
+
+func TestMaskBytes(t *testing.T) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for pos := 0; pos < 4; pos++ {
+		for start := 0; start < 9; start++ {
+			for _, n := range []int{0, 1, 3, 7, 8, 9, 15, 16, 17, 31, 64, 255} {
+				got := bytes.Clone(data[start : start+n])
+				want := bytes.Clone(got)
+				gotPos := maskBytes(key, pos, got)
+				wantPos := maskBytesBytewise(key, pos, want)
+				if !bytes.Equal(got, want) || gotPos != wantPos {
+					t.Fatalf("pos %d, offset %d, length %d: masked differently", pos, start, n)
+				}
+			}
+		}
+	}
+
+	// Masking in pieces continues where the previous piece stopped.
+	whole := bytes.Clone(data)
+	maskBytes(key, 0, whole)
+	pieces := bytes.Clone(data)
+	pos, rest := 0, pieces
+	for _, n := range []int{5, 1, 17, 8, 100, 3, 166} {
+		pos = maskBytes(key, pos, rest[:n])
+		rest = rest[n:]
+	}
+	if !bytes.Equal(whole, pieces) {
+		t.Fatal("masking in pieces differs from masking at once")
+	}
+}
+
+func BenchmarkMaskBytes(b *testing.B) {
+	for _, size := range []int{16, 1024, 64 * 1024, 16 * 1024 * 1024} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			data := make([]byte, size)
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				maskBytes([4]byte{1, 2, 3, 4}, 1, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package v13
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+)
+
+// rfcExamples are the frames of RFC 6455 5.7.
+var rfcExamples = [][]byte{
+	// A single-frame unmasked text message
+	{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f},
+	// A single-frame masked text message
+	{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58},
+	// A fragmented unmasked text message
+	{0x01, 0x03, 0x48, 0x65, 0x6c, 0x80, 0x02, 0x6c, 0x6f},
+	// Unmasked ping and masked pong
+	{0x89, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f},
+	{0x8a, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58},
+	// 256 bytes binary message in a single unmasked frame
+	append([]byte{0x82, 0x7e, 0x01, 0x00}, make([]byte, 256)...),
+	// 64KiB binary message in a single unmasked frame, cut off after its
+	// header: the fuzzer stalls minimizing inputs that large.
+	{0x82, 0x7f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00},
+}
+
+func FuzzReadFrame(f *testing.F) {
+	for _, example := range rfcExamples {
+		f.Add(example)
+	}
+	// A length with the most significant bit set and a forged huge length.
+	f.Add([]byte{0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4})
+	f.Add([]byte{0x82, 0x7f, 0, 0, 0x10, 0, 0, 0, 0, 0, 1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		br := bufio.NewReader(r)
+		frame, err := ReadFrame(br)
+		if err != nil {
+			return
+		}
+
+		// The payload must come from the input, not from a forged length.
+		if cap(frame.Payload) > len(data)+maxInitialPayload {
+			t.Fatalf("allocated %d bytes for %d bytes of input", cap(frame.Payload), len(data))
+		}
+
+		consumed := len(data) - r.Len() - br.Buffered()
+		header := consumed - len(frame.Payload)
+		if header < 2 || header > maxHeaderSize {
+			t.Fatalf("header of %d bytes", header)
+		}
+		if !bytes.Equal(frame.Payload, data[header:consumed]) {
+			t.Fatal("payload differs from the input")
+		}
+		if frame.Fin != (data[0]&0x80 != 0) || frame.Opcode != data[0]&0x0f || frame.Mask != (data[1]&0x80 != 0) {
+			t.Fatal("header bits differ from the input")
+		}
+
+		// Encoding the frame again must give the same frame back.
+		again, err := ReadFrame(bufio.NewReader(bytes.NewReader(frame.Bytes())))
+		if err != nil {
+			t.Fatalf("reading the encoded frame: %v", err)
+		}
+		if !equalFrames(frame, again) {
+			t.Fatalf("round trip changed the frame: %+v became %+v", frame, again)
+		}
+	})
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add(true, byte(0), byte(OpText), false, uint32(0), []byte("Hello"))
+	f.Add(true, byte(0), byte(OpText), true, uint32(0x37fa213d), []byte("Hello"))
+	f.Add(false, byte(4), byte(OpBinary), true, uint32(1), make([]byte, 126))
+	f.Add(true, byte(7), byte(OpPing), false, uint32(0), []byte{})
+
+	f.Fuzz(func(t *testing.T, fin bool, rsv byte, opcode byte, mask bool, key uint32, payload []byte) {
+		frame := &Frame{
+			Fin:     fin,
+			Rsv1:    rsv&4 != 0,
+			Rsv2:    rsv&2 != 0,
+			Rsv3:    rsv&1 != 0,
+			Opcode:  opcode & 0x0f,
+			Mask:    mask,
+			Payload: payload,
+		}
+		if mask {
+			frame.MaskKey = [4]byte{byte(key >> 24), byte(key >> 16), byte(key >> 8), byte(key)}
+		}
+
+		encoded := frame.Bytes()
+		got, err := ReadFrame(bufio.NewReader(bytes.NewReader(encoded)))
+		if isControl(frame.Opcode) && len(payload) > maxControlPayload {
+			if err == nil {
+				t.Fatal("control frame with a long payload was accepted")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !equalFrames(frame, got) {
+			t.Fatalf("round trip changed the frame: %+v became %+v", frame, got)
+		}
+	})
+}
+
+func equalFrames(a, b *Frame) bool {
+	return a.Fin == b.Fin && a.Rsv1 == b.Rsv1 && a.Rsv2 == b.Rsv2 && a.Rsv3 == b.Rsv3 &&
+		a.Opcode == b.Opcode && a.Mask == b.Mask && a.MaskKey == b.MaskKey && bytes.Equal(a.Payload, b.Payload)
+}
+
+// fuzzConn reads the fuzz input and discards what is written.
+type fuzzConn struct {
+	loopConn
+	r io.Reader
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func FuzzConnectionRead(f *testing.F) {
+	for _, example := range rfcExamples {
+		f.Add(example, false)
+	}
+	// "Hello" compressed as in RFC 7692 7.2.3.1.
+	f.Add([]byte{0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}, true)
+	// A frame claiming a terabyte of payload.
+	f.Add([]byte{0x82, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2a}, false)
+
+	f.Fuzz(func(t *testing.T, data []byte, compression bool) {
+		// The default of no read limit is bounded by the input alone:
+		// allocations follow the data that arrives, or what it inflates
+		// to, never a length read from a header.
+		budget := 1<<20 + 8*uint64(len(data))
+		if compression {
+			budget = 1<<20 + 2*maxDeflateRatio*uint64(len(data))
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		fuzzRead(t, data, compression, 0)
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > budget {
+			t.Fatalf("allocated %d bytes for %d bytes of input", allocated, len(data))
+		}
+
+		fuzzRead(t, data, compression, 1<<20)
+	})
+}
+
+// maxDeflateRatio is the most a deflate stream expands.
+const maxDeflateRatio = 1032
+
+// fuzzRead reads messages from data until it fails.
+func fuzzRead(t *testing.T, data []byte, compression bool, readLimit int64) {
+	// Read the frames as the client, which expects them unmasked.
+	conn := &fuzzConn{r: bytes.NewReader(data)}
+	c := newConnection(conn, bufio.NewReader(conn), defaultBufferSize, false)
+	if compression {
+		c.setCompression(&compressionParams{})
+	}
+	c.SetReadLimit(readLimit)
+
+	for {
+		op, message, err := c.Read()
+		if err != nil {
+			return
+		}
+		if op != OpText && op != OpBinary {
+			t.Fatalf("message with opcode %d", op)
+		}
+		if readLimit > 0 && int64(len(message)) > readLimit {
+			t.Fatalf("message of %d bytes exceeds the read limit", len(message))
+		}
+		if !compression && len(message) > len(data) {
+			t.Fatalf("message of %d bytes from %d bytes of input", len(message), len(data))
+		}
+	}
+}
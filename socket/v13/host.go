@@ -0,0 +1,126 @@
+package v13
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// requestHost returns the host the client asked for. Requests relayed by a
+// trusted proxy report the original host in Forwarded or X-Forwarded-Host.
+func (u *Upgrader) requestHost(r *http.Request) string {
+	if len(u.TrustedProxies) == 0 || !u.fromTrustedProxy(r) {
+		return r.Host
+	}
+
+	if host := forwardedHost(r.Header.Get("Forwarded")); host != "" {
+		return host
+	}
+
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		host, _, _ = strings.Cut(host, ",")
+		return strings.TrimSpace(host)
+	}
+
+	return r.Host
+}
+
+func (u *Upgrader) fromTrustedProxy(r *http.Request) bool {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range u.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHost returns the host parameter of the first element of a
+// Forwarded header (RFC 7239), which is the one added by the proxy closest
+// to the client.
+func forwardedHost(forwarded string) string {
+	first, _, _ := strings.Cut(forwarded, ",")
+	for _, pair := range strings.Split(first, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, "host") {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+func (u *Upgrader) checkHost(host string) bool {
+	hostname, port, ok := splitHost(host)
+	if !ok {
+		return false
+	}
+
+	if len(u.AllowedHosts) == 0 {
+		return true
+	}
+
+	for _, allowed := range u.AllowedHosts {
+		allowedHostname, allowedPort, ok := splitHost(allowed)
+		if !ok || (allowedPort != "" && allowedPort != port) {
+			continue
+		}
+
+		if allowedHostname == hostname {
+			return true
+		}
+
+		if suffix, ok := strings.CutPrefix(allowedHostname, "*"); ok && strings.HasPrefix(suffix, ".") &&
+			strings.HasSuffix(hostname, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHost splits a Host value into a normalized hostname and an optional
+// port. IPv6 literals may be given with or without brackets.
+func splitHost(host string) (hostname string, port string, ok bool) {
+	if host == "" {
+		return "", "", false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), "", true
+	}
+
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			hostname = host[1 : len(host)-1]
+		}
+		port = ""
+		// Only IPv6 literals have colons outside a port.
+		if strings.Contains(hostname, ":") && net.ParseIP(hostname) == nil {
+			return "", "", false
+		}
+	}
+
+	// Reject anything that is not a plain authority, e.g. a path or userinfo.
+	if parsed, err := url.Parse("//" + host); err != nil || parsed.Host != host || parsed.User != nil {
+		return "", "", false
+	}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		return ip.String(), port, true
+	}
+	return strings.TrimSuffix(strings.ToLower(hostname), "."), port, true
+}
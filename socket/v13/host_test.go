@@ -0,0 +1,177 @@
+package v13
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// upgradeResponse sends a handshake request for host with extra headers to a
+// server upgrading with u, and returns the response.
+func upgradeResponse(t *testing.T, u *Upgrader, host string, header http.Header) *http.Response {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := u.Upgrade(w, r); err == nil {
+			c.Close()
+		}
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestSplitHost(t *testing.T) {
+	tests := []struct {
+		host, hostname, port string
+		ok                   bool
+	}{
+		{"example.com", "example.com", "", true},
+		{"Example.COM.", "example.com", "", true},
+		{"example.com:8080", "example.com", "8080", true},
+		{"192.0.2.1", "192.0.2.1", "", true},
+		{"192.0.2.1:80", "192.0.2.1", "80", true},
+		{"::1", "::1", "", true},
+		{"[::1]", "::1", "", true},
+		{"[::1]:8080", "::1", "8080", true},
+		{"[0:0::1]:8080", "::1", "8080", true},
+		{"", "", "", false},
+		{"example.com/path", "", "", false},
+		{"user@example.com", "", "", false},
+		{"example.com:80:80", "", "", false},
+		{"example.com:http", "", "", false},
+		{"[example.com]", "", "", false},
+	}
+	for _, tt := range tests {
+		hostname, port, ok := splitHost(tt.host)
+		if hostname != tt.hostname || port != tt.port || ok != tt.ok {
+			t.Errorf("splitHost(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.host, hostname, port, ok, tt.hostname, tt.port, tt.ok)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		host    string
+		want    bool
+	}{
+		{nil, "anything.example", true},
+		{nil, "", false},
+		{nil, "example.com/path", false},
+		{[]string{"example.com"}, "example.com", true},
+		{[]string{"example.com"}, "EXAMPLE.com:443", true},
+		{[]string{"example.com"}, "evil.com", false},
+		{[]string{"example.com:8080"}, "example.com:8080", true},
+		{[]string{"example.com:8080"}, "example.com:9090", false},
+		{[]string{"example.com:8080"}, "example.com", false},
+		{[]string{"*.example.com"}, "api.example.com", true},
+		{[]string{"*.example.com"}, "a.b.example.com:443", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"*.example.com"}, "evilexample.com", false},
+		{[]string{"*example.com"}, "evilexample.com", false},
+		{[]string{"*.example.com:443"}, "api.example.com:80", false},
+		{[]string{"::1"}, "[::1]:8080", true},
+		{[]string{"[::1]:8080"}, "[::1]:8080", true},
+		{[]string{"[::1]:8080"}, "[::1]:80", false},
+		{[]string{"192.0.2.1"}, "192.0.2.1:80", true},
+		{[]string{"192.0.2.1"}, "192.0.2.10", false},
+		{[]string{"evil.com", "example.com"}, "example.com", true},
+	}
+	for _, tt := range tests {
+		u := &Upgrader{AllowedHosts: tt.allowed}
+		if got := u.checkHost(tt.host); got != tt.want {
+			t.Errorf("AllowedHosts %q, host %q: got %v, want %v", tt.allowed, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		remote  string
+		header  http.Header
+		want    string
+	}{
+		{"no proxies", nil, "192.0.2.1:1234",
+			http.Header{"X-Forwarded-Host": {"forwarded.com"}}, "example.com"},
+		{"untrusted peer", []string{"192.0.2.1"}, "198.51.100.7:1234",
+			http.Header{"X-Forwarded-Host": {"forwarded.com"}, "Forwarded": {"host=forwarded.com"}}, "example.com"},
+		{"trusted peer", []string{"192.0.2.1"}, "192.0.2.1:1234",
+			http.Header{"X-Forwarded-Host": {"forwarded.com"}}, "forwarded.com"},
+		{"trusted network", []string{"10.0.0.0/8"}, "10.1.2.3:1234",
+			http.Header{"X-Forwarded-Host": {"forwarded.com"}}, "forwarded.com"},
+		{"outside trusted network", []string{"10.0.0.0/8"}, "11.1.2.3:1234",
+			http.Header{"X-Forwarded-Host": {"forwarded.com"}}, "example.com"},
+		{"trusted IPv6 peer", []string{"2001:db8::/32"}, "[2001:db8::1]:1234",
+			http.Header{"X-Forwarded-Host": {"forwarded.com"}}, "forwarded.com"},
+		{"first of several hosts", []string{"192.0.2.1"}, "192.0.2.1:1234",
+			http.Header{"X-Forwarded-Host": {" first.com , second.com"}}, "first.com"},
+		{"Forwarded wins", []string{"192.0.2.1"}, "192.0.2.1:1234",
+			http.Header{"X-Forwarded-Host": {"x.com"}, "Forwarded": {"for=192.0.2.60;Host=fwd.com;proto=https"}}, "fwd.com"},
+		{"quoted Forwarded host", []string{"192.0.2.1"}, "192.0.2.1:1234",
+			http.Header{"Forwarded": {`host="[2001:db8::1]:8080", host=second.com`}}, "[2001:db8::1]:8080"},
+		{"Forwarded without host", []string{"192.0.2.1"}, "192.0.2.1:1234",
+			http.Header{"Forwarded": {"for=192.0.2.60"}, "X-Forwarded-Host": {"x.com"}}, "x.com"},
+		{"no forwarding headers", []string{"192.0.2.1"}, "192.0.2.1:1234", nil, "example.com"},
+		{"unparsable remote", []string{"192.0.2.1"}, "pipe",
+			http.Header{"X-Forwarded-Host": {"forwarded.com"}}, "example.com"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = tt.remote
+		for key, values := range tt.header {
+			r.Header[key] = values
+		}
+		u := &Upgrader{TrustedProxies: tt.trusted}
+		if got := u.requestHost(r); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpgradeHostCheck(t *testing.T) {
+	allowed := []string{"example.com"}
+	tests := []struct {
+		name     string
+		upgrader *Upgrader
+		host     string
+		header   http.Header
+		want     int
+	}{
+		{"allowed", &Upgrader{AllowedHosts: allowed}, "example.com", nil, http.StatusSwitchingProtocols},
+		{"not allowed", &Upgrader{AllowedHosts: allowed}, "evil.com", nil, http.StatusBadRequest},
+		{"malformed", &Upgrader{}, "evil.com/path", nil, http.StatusBadRequest},
+		{"skipped", &Upgrader{AllowedHosts: allowed, SkipHostCheck: true}, "evil.com", nil, http.StatusSwitchingProtocols},
+		{"forwarded by a trusted proxy", &Upgrader{AllowedHosts: allowed, TrustedProxies: []string{"127.0.0.0/8"}},
+			"internal:8080", http.Header{"X-Forwarded-Host": {"example.com"}}, http.StatusSwitchingProtocols},
+		{"forwarded by an untrusted peer", &Upgrader{AllowedHosts: allowed, TrustedProxies: []string{"192.0.2.1"}},
+			"evil.com", http.Header{"X-Forwarded-Host": {"example.com"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if resp := upgradeResponse(t, tt.upgrader, tt.host, tt.header); resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
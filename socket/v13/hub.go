@@ -0,0 +1,248 @@
+package v13
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultQueueSize = 64
+
+// SlowConsumerPolicy decides what a Hub does with a message for a connection
+// whose queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropMessages drops the message for that connection only.
+	DropMessages SlowConsumerPolicy = iota
+	// Disconnect closes the connection with ClosePolicyViolation.
+	Disconnect
+	// Block waits until the queue has room, which holds up the broadcast
+	// for every other connection.
+	Block
+)
+
+// Hub broadcasts messages to a set of connections. Every connection gets its
+// own queue and goroutine writing it, so one slow peer doesn't delay the
+// others. Connections leave the hub when they are closed. The zero value is
+// a valid Hub.
+type Hub struct {
+	// Upgrader upgrades the requests passed to Upgrade. When nil, the
+	// options of the package level Upgrade are used.
+	Upgrader *Upgrader
+	// QueueSize is the number of messages queued per connection, 64 by
+	// default.
+	QueueSize int
+	// SlowConsumer applies when a connection's queue is full.
+	SlowConsumer SlowConsumerPolicy
+	// WriteTimeout bounds writing a single message. A connection that
+	// doesn't take a message in time is closed. Zero means no timeout.
+	WriteTimeout time.Duration
+
+	mu    sync.RWMutex
+	conns map[*Connection]*hubConn
+}
+
+type hubConn struct {
+	c     *Connection
+	queue chan *PreparedMessage
+	// done is closed when the connection leaves the hub.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Upgrade upgrades the request and registers the connection.
+func (h *Hub) Upgrade(w http.ResponseWriter, r *http.Request) (*Connection, error) {
+	upgrader := h.Upgrader
+	if upgrader == nil {
+		upgrader = defaultUpgrader
+	}
+
+	c, err := upgrader.Upgrade(w, r)
+	if err != nil {
+		return nil, err
+	}
+	h.Register(c)
+	return c, nil
+}
+
+// Register adds c to the hub and reports whether it wasn't registered yet.
+// Registering a connection twice has no effect. The application still has to
+// read from c, or control frames and the peer's close go unanswered.
+func (h *Hub) Register(c *Connection) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.conns[c]; ok {
+		return false
+	}
+	if h.conns == nil {
+		h.conns = make(map[*Connection]*hubConn)
+	}
+
+	size := h.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	hc := &hubConn{
+		c:     c,
+		queue: make(chan *PreparedMessage, size),
+		done:  make(chan struct{}),
+	}
+	h.conns[c] = hc
+	go h.writeLoop(hc)
+	return true
+}
+
+// Unregister removes c from the hub without closing it. Messages still
+// queued for c are dropped.
+func (h *Hub) Unregister(c *Connection) {
+	h.mu.Lock()
+	hc := h.conns[c]
+	h.mu.Unlock()
+	if hc != nil {
+		h.remove(hc)
+	}
+}
+
+// Len returns the number of registered connections.
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns)
+}
+
+// Broadcast queues a text or binary message for every registered connection.
+// The message is encoded once for all of them.
+func (h *Hub) Broadcast(messageType byte, message []byte) error {
+	return h.BroadcastFilter(messageType, message, nil)
+}
+
+// BroadcastFilter queues a text or binary message for the registered
+// connections filter returns true for. A nil filter selects all of them.
+func (h *Hub) BroadcastFilter(messageType byte, message []byte, filter func(c *Connection) bool) error {
+	pm, err := NewPreparedMessage(messageType, message)
+	if err != nil {
+		return err
+	}
+
+	h.mu.RLock()
+	targets := make([]*hubConn, 0, len(h.conns))
+	for c, hc := range h.conns {
+		if filter == nil || filter(c) {
+			targets = append(targets, hc)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, hc := range targets {
+		h.enqueue(hc, pm)
+	}
+	return nil
+}
+
+// BroadcastTo queues a text or binary message for those of conns that are
+// registered.
+func (h *Hub) BroadcastTo(messageType byte, message []byte, conns ...*Connection) error {
+	pm, err := NewPreparedMessage(messageType, message)
+	if err != nil {
+		return err
+	}
+
+	h.mu.RLock()
+	targets := make([]*hubConn, 0, len(conns))
+	for _, c := range conns {
+		if hc, ok := h.conns[c]; ok {
+			targets = append(targets, hc)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, hc := range targets {
+		h.enqueue(hc, pm)
+	}
+	return nil
+}
+
+// BroadcastPrepared queues a prepared message for every registered
+// connection.
+func (h *Hub) BroadcastPrepared(pm *PreparedMessage) {
+	h.mu.RLock()
+	targets := make([]*hubConn, 0, len(h.conns))
+	for _, hc := range h.conns {
+		targets = append(targets, hc)
+	}
+	h.mu.RUnlock()
+
+	for _, hc := range targets {
+		h.enqueue(hc, pm)
+	}
+}
+
+func (h *Hub) enqueue(hc *hubConn, pm *PreparedMessage) {
+	select {
+	case hc.queue <- pm:
+		return
+	case <-hc.done:
+		return
+	default:
+	}
+
+	switch h.SlowConsumer {
+	case Disconnect:
+		h.remove(hc)
+		go hc.c.drop(ClosePolicyViolation, "Too slow to keep up")
+	case Block:
+		select {
+		case hc.queue <- pm:
+		case <-hc.done:
+		case <-hc.c.closed:
+		}
+	}
+}
+
+// writeLoop writes the queued messages to the connection until it leaves
+// the hub or is closed.
+func (h *Hub) writeLoop(hc *hubConn) {
+	defer h.remove(hc)
+
+	for {
+		select {
+		case pm := <-hc.queue:
+			if err := h.write(hc.c, pm); err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					hc.c.drop(ClosePolicyViolation, "Too slow to keep up")
+				}
+				return
+			}
+		case <-hc.done:
+			return
+		case <-hc.c.closed:
+			return
+		}
+	}
+}
+
+func (h *Hub) write(c *Connection, pm *PreparedMessage) error {
+	ctx := context.Background()
+	if h.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.WriteTimeout)
+		defer cancel()
+	}
+	return c.writePrepared(ctx, pm)
+}
+
+func (h *Hub) remove(hc *hubConn) {
+	h.mu.Lock()
+	if h.conns[hc.c] == hc {
+		delete(h.conns, hc.c)
+	}
+	h.mu.Unlock()
+
+	hc.doneOnce.Do(func() {
+		close(hc.done)
+	})
+}
@@ -0,0 +1,214 @@
+package v13
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeConns returns the server and client ends of a connection over
+// net.Pipe, where a write blocks until the peer reads it.
+func pipeConns(t *testing.T) (server, client *Connection) {
+	a, b := net.Pipe()
+	server = newConnection(a, bufio.NewReader(a), defaultBufferSize, true)
+	client = newConnection(b, bufio.NewReader(b), defaultBufferSize, false)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+// waitFor polls cond until it holds or three seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// readUntilQuiet reads messages until none arrived for a while.
+func readUntilQuiet(c *Connection) (messages []string, err error) {
+	for {
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, message, err := c.Read()
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, string(message))
+	}
+}
+
+func TestHubBroadcast(t *testing.T) {
+	const clients = 4
+	hub := &Hub{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := hub.Upgrade(w, r)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		for {
+			if _, _, err := c.Read(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	var conns []*Connection
+	for i := 0; i < clients; i++ {
+		conns = append(conns, dialTest(t, url, &DialOptions{EnableCompression: i%2 == 0}))
+	}
+	waitFor(t, "registration", func() bool { return hub.Len() == clients })
+
+	for i := 0; i < 10; i++ {
+		if err := hub.Broadcast(OpText, []byte(fmt.Sprint("message ", i))); err != nil {
+			t.Fatalf("broadcast: %v", err)
+		}
+	}
+	for _, c := range conns {
+		for i := 0; i < 10; i++ {
+			op, message, err := c.Read()
+			if err != nil || op != OpText || string(message) != fmt.Sprint("message ", i) {
+				t.Fatalf("got %q and %v, want message %d", message, err, i)
+			}
+		}
+	}
+
+	// Closed connections leave the hub.
+	conns[0].CloseWithReason(CloseNormalClosure, "")
+	conns[1].Close()
+	waitFor(t, "unregistration", func() bool { return hub.Len() == clients-2 })
+
+	if err := hub.Broadcast(OpText, []byte{0xff}); err == nil {
+		t.Error("broadcast of invalid UTF-8 succeeded")
+	}
+	if err := hub.Broadcast(OpPing, nil); err == nil {
+		t.Error("broadcast of a ping succeeded")
+	}
+}
+
+func TestHubBroadcastFilter(t *testing.T) {
+	hub := &Hub{}
+	server1, client1 := pipeConns(t)
+	server2, client2 := pipeConns(t)
+	hub.Register(server1)
+	hub.Register(server2)
+	if hub.Register(server2) {
+		t.Error("second registration reported as new")
+	}
+	if hub.Len() != 2 {
+		t.Fatalf("%d connections registered, want 2", hub.Len())
+	}
+
+	hub.BroadcastFilter(OpBinary, []byte("only 2"), func(c *Connection) bool { return c == server2 })
+	hub.Broadcast(OpBinary, []byte("all"))
+
+	messages, _ := readUntilQuiet(client1)
+	if fmt.Sprint(messages) != "[all]" {
+		t.Errorf("first connection got %q", messages)
+	}
+	messages, _ = readUntilQuiet(client2)
+	if fmt.Sprint(messages) != "[only 2 all]" {
+		t.Errorf("second connection got %q", messages)
+	}
+
+	hub.BroadcastTo(OpBinary, []byte("only 1"), server1)
+	if messages, _ := readUntilQuiet(client1); fmt.Sprint(messages) != "[only 1]" {
+		t.Errorf("first connection got %q", messages)
+	}
+
+	hub.Unregister(server1)
+	hub.Broadcast(OpBinary, []byte("after"))
+	hub.BroadcastTo(OpBinary, []byte("after"), server1)
+	if messages, _ := readUntilQuiet(client1); len(messages) != 0 {
+		t.Errorf("unregistered connection got %q", messages)
+	}
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		hub := &Hub{QueueSize: 1, SlowConsumer: DropMessages}
+		server, client := pipeConns(t)
+		hub.Register(server)
+
+		// The peer doesn't read yet: one message is being written, one
+		// is queued and the rest are dropped.
+		for i := 0; i < 10; i++ {
+			hub.Broadcast(OpText, []byte(fmt.Sprint(i)))
+		}
+		messages, _ := readUntilQuiet(client)
+		if len(messages) < 1 || len(messages) > 2 {
+			t.Errorf("got %q, want at most two messages", messages)
+		}
+		if hub.Len() != 1 {
+			t.Error("slow connection was unregistered")
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		hub := &Hub{QueueSize: 1, SlowConsumer: Disconnect}
+		server, client := pipeConns(t)
+		hub.Register(server)
+
+		for i := 0; i < 10; i++ {
+			hub.Broadcast(OpText, []byte(fmt.Sprint(i)))
+		}
+		if hub.Len() != 0 {
+			t.Error("slow connection is still registered")
+		}
+		_, err := readUntilQuiet(client)
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != ClosePolicyViolation {
+			t.Errorf("got %v, want close code %d", err, ClosePolicyViolation)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		hub := &Hub{QueueSize: 1, SlowConsumer: Block}
+		server, client := pipeConns(t)
+		hub.Register(server)
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 5; i++ {
+				hub.Broadcast(OpText, []byte(fmt.Sprint(i)))
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatal("broadcast didn't wait for the slow connection")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		messages, _ := readUntilQuiet(client)
+		<-done
+		if fmt.Sprint(messages) != "[0 1 2 3 4]" {
+			t.Errorf("got %q, want all messages in order", messages)
+		}
+	})
+
+	t.Run("write timeout", func(t *testing.T) {
+		hub := &Hub{WriteTimeout: 50 * time.Millisecond}
+		server, client := pipeConns(t)
+		hub.Register(server)
+
+		hub.Broadcast(OpText, []byte("never read"))
+		waitFor(t, "unregistration", func() bool { return hub.Len() == 0 })
+		if _, err := readUntilQuiet(client); err == nil {
+			t.Error("connection is still open")
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package v13
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keepaliveEpoch is the reference point of the timestamps sent in pings.
+var keepaliveEpoch = time.Now()
+
+// Stats are the round-trip times measured by the keepalive.
+type Stats struct {
+	// LastRTT is the round-trip time of the latest pong, zero before the
+	// first one arrived.
+	LastRTT time.Duration
+	// AverageRTT is the mean round-trip time of all pongs.
+	AverageRTT time.Duration
+}
+
+type keepalive struct {
+	mu sync.Mutex
+	// stop ends the running keepalive goroutine, nil if none runs.
+	stop chan struct{}
+	// pong is signalled when the pending ping was answered.
+	pong chan struct{}
+	// pending is the payload of the ping awaiting its pong.
+	pending  []byte
+	lastRTT  time.Duration
+	totalRTT time.Duration
+	pongs    int64
+	timedOut atomic.Bool
+}
+
+// SetKeepalive pings the peer every interval. If the pong doesn't arrive
+// within timeout, the connection is closed with CloseGoingAway and reads fail
+// with a *CloseError of CloseAbnormalClosure. Pongs are only received while a
+// goroutine is reading. A timeout of zero or less uses the interval, an
+// interval of zero or less turns the keepalive off.
+func (c *Connection) SetKeepalive(interval, timeout time.Duration) {
+	k := &c.keepalive
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.stop != nil {
+		close(k.stop)
+		k.stop = nil
+	}
+	k.pending = nil
+	if interval <= 0 {
+		return
+	}
+
+	if timeout <= 0 {
+		timeout = interval
+	}
+	k.stop = make(chan struct{})
+	k.pong = make(chan struct{}, 1)
+	go c.runKeepalive(k.stop, k.pong, interval, timeout)
+}
+
+// Stats returns the round-trip times measured from the pongs answering the
+// keepalive pings.
+func (c *Connection) Stats() Stats {
+	k := &c.keepalive
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	stats := Stats{LastRTT: k.lastRTT}
+	if k.pongs > 0 {
+		stats.AverageRTT = k.totalRTT / time.Duration(k.pongs)
+	}
+	return stats
+}
+
+func (c *Connection) runKeepalive(stop, pong chan struct{}, interval, timeout time.Duration) {
+	k := &c.keepalive
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-c.closed:
+			return
+		}
+
+		// The peer echoes the send time, which gives the round-trip time
+		// without remembering every ping.
+		payload := binary.BigEndian.AppendUint64(nil, uint64(time.Since(keepaliveEpoch)))
+		k.mu.Lock()
+		k.pending = payload
+		k.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := c.WriteContext(ctx, OpPing, payload)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			c.keepaliveTimedOut()
+			return
+		}
+		if err != nil {
+			// The connection is closing or already broken.
+			return
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case <-pong:
+			timer.Stop()
+		case <-timer.C:
+			c.keepaliveTimedOut()
+			return
+		case <-stop:
+			timer.Stop()
+			return
+		case <-c.closed:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// handlePong records the round-trip time if payload answers the pending ping.
+func (k *keepalive) handlePong(payload []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.pending == nil || !bytes.Equal(payload, k.pending) {
+		return
+	}
+	k.pending = nil
+
+	rtt := time.Since(keepaliveEpoch) - time.Duration(binary.BigEndian.Uint64(payload))
+	k.lastRTT = rtt
+	k.totalRTT += rtt
+	k.pongs++
+	select {
+	case k.pong <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Connection) keepaliveTimedOut() {
+	c.keepalive.timedOut.Store(true)
+	c.drop(CloseGoingAway, "Keepalive timed out")
+}
@@ -0,0 +1,192 @@
+package v13
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// NextReader returns the type of the next text or binary message and a
+// reader for its payload. The reader spans all fragments of the message
+// without buffering it, and control frames arriving between fragments are
+// handled as in Read. Text messages are checked for valid UTF-8 as they are
+// read. Any unread part of the previous message is discarded.
+func (c *Connection) NextReader() (messageType byte, r io.Reader, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.reader != nil {
+		c.readMu.Unlock()
+		_, err := io.Copy(io.Discard, c.reader)
+		c.readMu.Lock()
+		if err != nil {
+			return 0, nil, err
+		}
+		c.reader = nil
+		c.msgReader = nil
+	}
+
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	frame, err := c.nextFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if frame.Opcode == OpContinuation {
+		return 0, nil, c.fail(CloseProtocolError, "Continuation frame without a message start")
+	}
+
+	c.msgReader = &messageReader{c: c}
+	c.reader = c.msgReader
+	if frame.Rsv1 {
+		c.reader = c.decompressor.reader(c, c.msgReader)
+	}
+	if frame.Opcode == OpText {
+		c.reader = &textReader{c: c, r: c.reader}
+	}
+	return frame.Opcode, c.reader, nil
+}
+
+type messageReader struct {
+	c *Connection
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	c := r.c
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.msgReader != r {
+		return 0, fmt.Errorf("conn: Read from a message reader that is no longer current")
+	}
+
+	for c.readRemaining == 0 {
+		if c.readFinal {
+			return 0, io.EOF
+		}
+
+		frame, err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		if frame.Opcode != OpContinuation {
+			return 0, c.fail(CloseProtocolError, "New message started inside a fragmented message")
+		}
+	}
+
+	if int64(len(p)) > c.readRemaining {
+		p = p[:c.readRemaining]
+	}
+
+	n, err := c.br.Read(p)
+	c.readRemaining -= int64(n)
+	if c.readMasked {
+		c.readMaskPos = maskBytes(c.readMaskKey, c.readMaskPos, p[:n])
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && !isTimeout(err) {
+		err = c.readFailed(err)
+	}
+	return n, err
+}
+
+// NextWriter returns a writer for a text or binary message. The payload is
+// sent in fragments whenever the write buffer fills up, and Close sends the
+// final frame. Other data messages wait until the writer is closed. A failed
+// write leaves the message unfinished, so it closes the connection. Writes
+// that would make a text message invalid UTF-8 are rejected.
+func (c *Connection) NextWriter(messageType byte) (io.WriteCloser, error) {
+	if isControl(messageType) || messageType == OpContinuation {
+		return nil, fmt.Errorf("conn: Invalid message type %d for NextWriter", messageType)
+	}
+
+	c.lock(context.Background(), c.msgLock)
+
+	bp := getBuffer(c.writeBufferSize)
+	w := &messageWriter{
+		c:      c,
+		opcode: messageType,
+		bufp:   bp,
+		buf:    (*bp)[:0:c.writeBufferSize],
+	}
+
+	var mw io.WriteCloser = w
+	if c.writeCompress && c.compressor != nil {
+		w.compressed = true
+		cw, err := c.compressor.writer(w)
+		if err != nil {
+			c.unlock(c.msgLock)
+			return nil, err
+		}
+		mw = cw
+	}
+	if messageType == OpText {
+		mw = &textWriter{c: c, w: mw}
+	}
+	return mw, nil
+}
+
+type messageWriter struct {
+	c          *Connection
+	opcode     byte
+	compressed bool
+	// buf is the pooled *bufp, returned to the pool on Close. Its capacity
+	// is the write buffer size, the size of the fragments.
+	bufp   *[]byte
+	buf    []byte
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("conn: Write to a closed message writer")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flushFrame(false); err != nil {
+				return n, err
+			}
+		}
+
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.c.unlock(w.c.msgLock)
+	err := w.flushFrame(true)
+	putBuffer(w.bufp)
+	w.buf = nil
+	return err
+}
+
+func (w *messageWriter) flushFrame(final bool) error {
+	frame := NewFrame(final, w.opcode, false, [4]byte{}, w.buf)
+	frame.Rsv1 = w.compressed
+	err := w.c.writeFrame(context.Background(), frame)
+	if err != nil && err != ErrCloseSent {
+		w.c.failWrites(err)
+	}
+
+	w.opcode = OpContinuation
+	w.compressed = false
+	w.buf = w.buf[:0]
+	return err
+}
@@ -0,0 +1,160 @@
+package v13
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestNextWriter(t *testing.T) {
+	c, peer := rawClient(t)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p := pipePeer(peer)
+	message := make([]byte, 3*defaultBufferSize+100)
+	for i := range message {
+		message[i] = byte(rand.IntN(256))
+	}
+
+	// Fragments keep to the write buffer size with larger buffers pooled.
+	putBuffer(getBuffer(4 * defaultBufferSize))
+	w, err := c.NextWriter(OpBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan struct{})
+	go func() {
+		w.Write(message)
+		close(written)
+	}()
+
+	// Full buffers go out as fragments before the writer is closed.
+	var got []byte
+	for i := 0; i < 3; i++ {
+		frame, err := ReadFrame(p.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := byte(OpContinuation)
+		if i == 0 {
+			want = OpBinary
+		}
+		if frame.Opcode != want || frame.Fin || len(frame.Payload) != defaultBufferSize {
+			t.Fatalf("fragment %d: got opcode %d, fin %v and %d bytes", i, frame.Opcode, frame.Fin, len(frame.Payload))
+		}
+		got = append(got, frame.Payload...)
+	}
+
+	<-written
+	go w.Close()
+	frame, err := ReadFrame(p.br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Opcode != OpContinuation || !frame.Fin {
+		t.Fatalf("got opcode %d and fin %v, want the final continuation frame", frame.Opcode, frame.Fin)
+	}
+	if got = append(got, frame.Payload...); !bytes.Equal(got, message) {
+		t.Error("reassembled fragments differ from the message")
+	}
+
+	for _, op := range []byte{OpContinuation, OpPing, OpPong, OpClose} {
+		if _, err := c.NextWriter(op); err == nil {
+			t.Errorf("NextWriter accepted opcode %d", op)
+		}
+	}
+	w, _ = c.NextWriter(OpText)
+	if _, err := w.Write([]byte("\xff")); err == nil {
+		t.Error("invalid UTF-8 was written")
+	}
+}
+
+func TestNextReader(t *testing.T) {
+	c, peer := rawClient(t)
+	p := pipePeer(peer)
+	go p.send(false, OpText, []byte("first "))
+
+	op, r, err := c.NextReader()
+	if err != nil || op != OpText {
+		t.Fatalf("got opcode %d and %v", op, err)
+	}
+	// The first fragment can be read before the rest of the message was
+	// sent.
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "first " {
+		t.Fatalf("got %q and %v", buf, err)
+	}
+
+	go func() {
+		p.send(false, OpContinuation, []byte("second "))
+		p.send(true, OpPing, []byte("ping"))
+		p.send(true, OpContinuation, []byte("third"))
+	}()
+	go p.expect(OpPong, []byte("ping"))
+	if rest, err := io.ReadAll(r); err != nil || string(rest) != "second third" {
+		t.Fatalf("got %q and %v", rest, err)
+	}
+
+	// The unread rest of a message is skipped by the next NextReader.
+	go func() {
+		p.send(true, OpBinary, []byte("skipped"))
+		p.send(true, OpBinary, []byte("next"))
+	}()
+	_, r, _ = c.NextReader()
+	r.Read(make([]byte, 2))
+	op, r2, err := c.NextReader()
+	if err != nil || op != OpBinary {
+		t.Fatalf("got opcode %d and %v", op, err)
+	}
+	if message, err := io.ReadAll(r2); err != nil || string(message) != "next" {
+		t.Fatalf("got %q and %v", message, err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Error("read from the previous reader succeeded")
+	}
+}
+
+// TestStreamLargeMessage copies a message larger than any buffer through
+// NextWriter and NextReader.
+func TestStreamLargeMessage(t *testing.T) {
+	message := make([]byte, 4<<20)
+	for i := range message {
+		message[i] = byte(i)
+	}
+
+	url := newTestServer(t, &Upgrader{}, func(c *Connection) {
+		defer c.Close()
+		op, r, err := c.NextReader()
+		if err != nil {
+			t.Errorf("server: %v", err)
+			return
+		}
+		w, err := c.NextWriter(op)
+		if err != nil {
+			t.Errorf("server: %v", err)
+			return
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			t.Errorf("server: %v", err)
+		}
+		w.Close()
+	})
+
+	c := dialTest(t, url, nil)
+	go func() {
+		w, err := c.NextWriter(OpBinary)
+		if err != nil {
+			return
+		}
+		w.Write(message)
+		w.Close()
+	}()
+	op, r, err := c.NextReader()
+	if err != nil || op != OpBinary {
+		t.Fatalf("got opcode %d and %v", op, err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, message) {
+		t.Fatalf("got %d bytes and %v, want the %d bytes sent", len(got), err, len(message))
+	}
+}
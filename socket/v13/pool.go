@@ -0,0 +1,27 @@
+package v13
+
+import "sync"
+
+// maxPooledBuffer keeps the buffers of unusually large messages out of the
+// pool.
+const maxPooledBuffer = 1 << 20
+
+// bufferPool holds the buffers used for masked and compressed payloads and
+// by message writers, so busy connections don't allocate them per message.
+var bufferPool sync.Pool
+
+// getBuffer returns a buffer of length n from the pool.
+func getBuffer(n int) *[]byte {
+	if bp, ok := bufferPool.Get().(*[]byte); ok && cap(*bp) >= n {
+		*bp = (*bp)[:n]
+		return bp
+	}
+	b := make([]byte, n)
+	return &b
+}
+
+func putBuffer(bp *[]byte) {
+	if cap(*bp) <= maxPooledBuffer {
+		bufferPool.Put(bp)
+	}
+}
@@ -0,0 +1,111 @@
+package v13
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+)
+
+// PreparedMessage is a text or binary message encoded once and written to
+// any number of connections with WritePrepared. The compressed frame for
+// connections using permessage-deflate is made on first use.
+type PreparedMessage struct {
+	messageType byte
+	data        []byte
+
+	mu sync.Mutex
+	// frame is the encoded server frame, compressed holds the compressed
+	// variants by compression level.
+	frame      []byte
+	compressed map[int][]byte
+}
+
+// NewPreparedMessage prepares a text or binary message. data is copied.
+func NewPreparedMessage(messageType byte, data []byte) (*PreparedMessage, error) {
+	if messageType != OpText && messageType != OpBinary {
+		return nil, fmt.Errorf("conn: Can only prepare text and binary messages")
+	}
+	if messageType == OpText && !utf8.Valid(data) {
+		return nil, fmt.Errorf("conn: Message is not valid UTF-8")
+	}
+
+	data = append([]byte(nil), data...)
+	return &PreparedMessage{
+		messageType: messageType,
+		data:        data,
+		frame:       NewFrame(true, messageType, false, [4]byte{}, data).Bytes(),
+	}, nil
+}
+
+// compressedFrame returns the frame compressed at the given level. It is
+// compressed without context, so every connection can send it.
+func (pm *PreparedMessage) compressedFrame(level int) ([]byte, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if frame, ok := pm.compressed[level]; ok {
+		return frame, nil
+	}
+
+	c := &compressor{noContextTakeover: true, level: level}
+	payload, err := c.compress(nil, pm.data)
+	if err != nil {
+		return nil, err
+	}
+	frame := NewFrame(true, pm.messageType, false, [4]byte{}, payload)
+	frame.Rsv1 = true
+
+	if pm.compressed == nil {
+		pm.compressed = make(map[int][]byte)
+	}
+	pm.compressed[level] = frame.Bytes()
+	return pm.compressed[level], nil
+}
+
+// WritePrepared sends a prepared message. Servers write the frame as it was
+// encoded; clients mask every frame with a new key, so they encode it anew.
+func (c *Connection) WritePrepared(pm *PreparedMessage) error {
+	return c.writePrepared(context.Background(), pm)
+}
+
+func (c *Connection) writePrepared(ctx context.Context, pm *PreparedMessage) error {
+	if !c.isServer {
+		return c.WriteContext(ctx, pm.messageType, pm.data)
+	}
+
+	if err := c.lock(ctx, c.msgLock); err != nil {
+		return err
+	}
+	defer c.unlock(c.msgLock)
+
+	frame := pm.frame
+	compressed := c.writeCompress && c.compressor != nil
+	if compressed {
+		var err error
+		if frame, err = pm.compressedFrame(c.compressor.level); err != nil {
+			return err
+		}
+	}
+
+	if err := c.lock(ctx, c.writeLock); err != nil {
+		return err
+	}
+	defer c.unlock(c.writeLock)
+
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	c.writeVec = [2][]byte{frame}
+	err := c.writeVecLocked(ctx, pm.messageType)
+	if compressed && err == nil && !c.compressor.noContextTakeover {
+		// The peer's window now ends with this message while ours doesn't,
+		// the next message must not refer back past it.
+		c.compressor.reset()
+	}
+	return err
+}
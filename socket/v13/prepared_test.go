@@ -0,0 +1,103 @@
+package v13
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWritePrepared(t *testing.T) {
+	text := strings.Repeat("prepared κόσμε ", 500)
+	pm, err := NewPreparedMessage(OpText, []byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name              string
+		compression       *compressionParams
+		serverWritesFirst bool
+	}{
+		{"server", nil, true},
+		{"client", nil, false},
+		{"server/compression", &compressionParams{}, true},
+		{"server/compression/no context takeover", &compressionParams{serverNoContextTakeover: true}, true},
+		{"client/compression", &compressionParams{}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			server := newConnection(a, bufio.NewReader(a), defaultBufferSize, true)
+			client := newConnection(b, bufio.NewReader(b), defaultBufferSize, false)
+			server.setCompression(tt.compression)
+			client.setCompression(tt.compression)
+			defer server.Close()
+			defer client.Close()
+
+			writer, reader := server, client
+			if !tt.serverWritesFirst {
+				writer, reader = client, server
+			}
+
+			// Prepared messages in between regular ones must not break the
+			// compression context.
+			go func() {
+				for i := 0; i < 3; i++ {
+					writer.Write(OpText, []byte(fmt.Sprint("regular ", i, text)))
+					writer.WritePrepared(pm)
+				}
+			}()
+			for i := 0; i < 3; i++ {
+				if _, message, err := reader.Read(); err != nil || string(message) != fmt.Sprint("regular ", i, text) {
+					t.Fatalf("regular message %d: got %d bytes and %v", i, len(message), err)
+				}
+				if op, message, err := reader.Read(); err != nil || op != OpText || string(message) != text {
+					t.Fatalf("prepared message %d: got %d bytes and %v", i, len(message), err)
+				}
+			}
+		})
+	}
+
+	if _, err := NewPreparedMessage(OpText, []byte{0xff}); err == nil {
+		t.Error("prepared invalid UTF-8")
+	}
+	if _, err := NewPreparedMessage(OpPing, nil); err == nil {
+		t.Error("prepared a ping")
+	}
+}
+
+// BenchmarkBroadcast writes one message to many server connections.
+func BenchmarkBroadcast(b *testing.B) {
+	const conns = 1000
+	message := []byte(strings.Repeat("broadcast ", 100))
+	for _, compression := range []bool{false, true} {
+		var cs []*Connection
+		for i := 0; i < conns; i++ {
+			conn := &loopConn{}
+			c := newConnection(conn, bufio.NewReader(conn), defaultBufferSize, true)
+			if compression {
+				c.setCompression(&compressionParams{serverNoContextTakeover: true})
+			}
+			cs = append(cs, c)
+		}
+
+		b.Run(fmt.Sprintf("compression=%v/Write", compression), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, c := range cs {
+					c.Write(OpText, message)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("compression=%v/WritePrepared", compression), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pm, _ := NewPreparedMessage(OpText, message)
+				for _, c := range cs {
+					c.WritePrepared(pm)
+				}
+			}
+		})
+	}
+}
@@ -8,10 +8,54 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
+	"time"
 )
 
+// Upgrader holds the options for upgrading HTTP requests to WebSocket
+// connections. The zero value is a valid Upgrader.
+type Upgrader struct {
+	// Subprotocols lists the subprotocols the server supports in order of
+	// preference. The first one also offered by the client is selected.
+	Subprotocols []string
+	// CheckOrigin decides whether the request's Origin is allowed. When nil,
+	// only same-origin requests and requests without an Origin are accepted.
+	CheckOrigin func(r *http.Request) bool
+	// ResponseHeader is added to the 101 Switching Protocols response.
+	ResponseHeader http.Header
+	// ReadBufferSize and WriteBufferSize default to 4096 bytes.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// HandshakeTimeout bounds writing the handshake response. Zero means
+	// no timeout.
+	HandshakeTimeout time.Duration
+	// EnableCompression accepts permessage-deflate offers from clients.
+	EnableCompression bool
+
+	// AllowedHosts restricts the Host the client connects to. Entries are
+	// "host", "host:port" or "*.domain" patterns; an entry without a port
+	// matches any port. When empty, any well-formed Host is accepted.
+	AllowedHosts []string
+	// SkipHostCheck disables Host validation entirely.
+	SkipHostCheck bool
+	// TrustedProxies lists IP addresses or CIDR ranges of reverse proxies.
+	// For requests coming from them the Forwarded and X-Forwarded-Host
+	// headers take the place of Host.
+	TrustedProxies []string
+}
+
+var defaultUpgrader = &Upgrader{}
+
+// Upgrade upgrades the request with the options of a zero Upgrader, so
+// compression is not negotiated: that takes an Upgrader with
+// EnableCompression set.
 func Upgrade(w http.ResponseWriter, r *http.Request) (*Connection, error) {
+	return defaultUpgrader.Upgrade(w, r)
+}
+
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Connection, error) {
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -24,24 +68,96 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (*Connection, error) {
 		return nil, fmt.Errorf("server: Could not hijack connection: %v", err)
 	}
 
-	sHost := conn.LocalAddr().String()
-	if !validateHeaders(conn, buf, r.Header, sHost, r.Host) {
+	if u.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(u.HandshakeTimeout))
+	}
+
+	host := u.requestHost(r)
+	if !u.SkipHostCheck && !u.checkHost(host) {
+		errorWithStatus(conn, buf, http.StatusBadRequest, http.Header{})
+		return nil, fmt.Errorf("server: Invalid host: %s", host)
+	}
+
+	if !validateHeaders(conn, buf, r.Header) {
 		return nil, fmt.Errorf("server: Invalid headers")
 	}
 
-	serverHandshake(buf, r.Header)
-	return NewConnection(conn), nil
+	allowed := false
+	if u.CheckOrigin != nil {
+		allowed = u.CheckOrigin(r)
+	} else {
+		allowed = checkSameOrigin(r, host)
+	}
+	if !allowed {
+		errorWithStatus(conn, buf, http.StatusForbidden, http.Header{})
+		return nil, fmt.Errorf("server: Origin %q not allowed", r.Header.Get("Origin"))
+	}
+
+	subprotocol := u.selectSubprotocol(r.Header)
+	var compression *compressionParams
+	if u.EnableCompression {
+		compression = negotiateCompression(r.Header)
+	}
+
+	if err := serverHandshake(buf, r.Header, u.ResponseHeader, subprotocol, compression); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("server: Could not write handshake: %v", err)
+	}
+
+	if u.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+
+	// Frames the client sent right after its request may already be buffered.
+	br := buf.Reader
+	if br.Buffered() == 0 {
+		br = bufio.NewReaderSize(conn, bufferSize(u.ReadBufferSize))
+	}
+	c := newConnection(conn, br, bufferSize(u.WriteBufferSize), true)
+	c.subprotocol = subprotocol
+	c.setCompression(compression)
+	return c, nil
 }
 
-func validateHeaders(conn net.Conn, buf *bufio.ReadWriter, headers http.Header, sHost string, cHost string) bool {
-	cHost = strings.Replace(cHost, "localhost", "127.0.0.1", 1)
+// Subprotocols returns the subprotocols the client offers in its handshake
+// request, in the client's order of preference.
+func Subprotocols(r *http.Request) []string {
+	return headerTokens(r.Header, "Sec-WebSocket-Protocol")
+}
 
-	if cHost != sHost {
-		errorWithStatus(conn, buf, http.StatusBadRequest, http.Header{})
-		log.Printf("server: Invalid host: %s, expected: %s", cHost, sHost)
+func (u *Upgrader) selectSubprotocol(headers http.Header) string {
+	offered := headerTokens(headers, "Sec-WebSocket-Protocol")
+	for _, subprotocol := range u.Subprotocols {
+		if slices.Contains(offered, subprotocol) {
+			return subprotocol
+		}
+	}
+	return ""
+}
+
+// checkSameOrigin accepts requests without an Origin header (non-browser
+// clients) and requests whose Origin host matches the requested host.
+func checkSameOrigin(r *http.Request, host string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
 		return false
 	}
+	return strings.EqualFold(u.Host, host)
+}
+
+func bufferSize(size int) int {
+	if size <= 0 {
+		return defaultBufferSize
+	}
+	return size
+}
 
+func validateHeaders(conn net.Conn, buf *bufio.ReadWriter, headers http.Header) bool {
 	if strings.ToLower(headers.Get("Upgrade")) != "websocket" {
 		errorWithStatus(conn, buf, http.StatusBadRequest, http.Header{})
 		return false
@@ -69,19 +185,9 @@ func validateHeaders(conn net.Conn, buf *bufio.ReadWriter, headers http.Header,
 	return true
 }
 
-func serverHandshake(buf *bufio.ReadWriter, headers http.Header) {
+func serverHandshake(buf *bufio.ReadWriter, headers http.Header, responseHeader http.Header, subprotocol string, compression *compressionParams) error {
 	key := headers.Get("Sec-WebSocket-Key")
 
-	subprotocol := headers.Get("Sec-WebSocket-Protocol")
-	if subprotocol != "" {
-		subprotocol, _, _ = strings.Cut(subprotocol, ",")
-	}
-
-	extensions := headers.Get("Sec-WebSocket-Extensions")
-	if extensions != "" {
-		extensions, _, _ = strings.Cut(extensions, ";")
-	}
-
 	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
 	buf.WriteString("Upgrade: websocket\r\n")
 	buf.WriteString("Connection: Upgrade\r\n")
@@ -89,11 +195,34 @@ func serverHandshake(buf *bufio.ReadWriter, headers http.Header) {
 	if subprotocol != "" {
 		buf.WriteString(fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", subprotocol))
 	}
-	if extensions != "" {
-		buf.WriteString(fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n", extensions))
+	if compression != nil {
+		buf.WriteString(fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n", compression))
+	}
+	for key, values := range responseHeader {
+		switch http.CanonicalHeaderKey(key) {
+		case "Upgrade", "Connection", "Sec-Websocket-Accept", "Sec-Websocket-Protocol", "Sec-Websocket-Extensions":
+			continue
+		}
+
+		for _, value := range values {
+			buf.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+		}
 	}
 	buf.WriteString("\r\n")
-	buf.Flush()
+	return buf.Flush()
+}
+
+// headerTokens returns the comma-separated tokens of all values of a header.
+func headerTokens(headers http.Header, name string) []string {
+	var tokens []string
+	for _, value := range headers.Values(name) {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
 }
 
 func computeAcceptKey(key string) string {
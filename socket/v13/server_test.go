@@ -0,0 +1,166 @@
+package v13
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSubprotocol(t *testing.T) {
+	tests := []struct {
+		supported []string
+		offered   []string
+		want      string
+	}{
+		{nil, []string{"chat"}, ""},
+		{[]string{"chat"}, nil, ""},
+		{[]string{"chat"}, []string{"chat"}, "chat"},
+		{[]string{"chat"}, []string{"superchat, chat"}, "chat"},
+		{[]string{"chat"}, []string{"superchat", "chat"}, "chat"},
+		{[]string{"chat"}, []string{"superchat"}, ""},
+		// The server's preference wins over the client's order.
+		{[]string{"v2", "v1"}, []string{"v1, v2"}, "v2"},
+		{[]string{"v2", "v1"}, []string{"v1"}, "v1"},
+	}
+	for _, tt := range tests {
+		u := &Upgrader{Subprotocols: tt.supported}
+		resp := upgradeResponse(t, u, "", http.Header{"Sec-Websocket-Protocol": tt.offered})
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("got status %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != tt.want {
+			t.Errorf("supported %q, offered %q: selected %q, want %q", tt.supported, tt.offered, got, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header["Sec-Websocket-Protocol"] = []string{"v1, v2", " chat ,", "v1"}
+	if got := Subprotocols(r); !slices.Equal(got, []string{"v1", "v2", "chat", "v1"}) {
+		t.Errorf("Subprotocols = %q", got)
+	}
+
+	url := newTestServer(t, &Upgrader{Subprotocols: []string{"v2", "v1"}}, func(c *Connection) {
+		if c.Subprotocol() != "v1" {
+			t.Errorf("server: got subprotocol %q, want v1", c.Subprotocol())
+		}
+		c.Close()
+	})
+	if c := dialTest(t, url, &DialOptions{Subprotocols: []string{"v1"}}); c.Subprotocol() != "v1" {
+		t.Errorf("client: got subprotocol %q, want v1", c.Subprotocol())
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowAll := func(r *http.Request) bool { return true }
+	tests := []struct {
+		name   string
+		check  func(r *http.Request) bool
+		origin string
+		want   int
+	}{
+		{"no origin", nil, "", http.StatusSwitchingProtocols},
+		{"same origin", nil, "https://example.com", http.StatusSwitchingProtocols},
+		{"same origin in other case", nil, "https://EXAMPLE.com", http.StatusSwitchingProtocols},
+		{"other host", nil, "https://evil.com", http.StatusForbidden},
+		{"other port", nil, "https://example.com:8080", http.StatusForbidden},
+		{"subdomain", nil, "https://api.example.com", http.StatusForbidden},
+		{"malformed", nil, "://example.com", http.StatusForbidden},
+		{"custom check", allowAll, "https://evil.com", http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		u := &Upgrader{CheckOrigin: tt.check}
+		if resp := upgradeResponse(t, u, "example.com", header); resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	u := &Upgrader{
+		Subprotocols: []string{"chat"},
+		ResponseHeader: http.Header{
+			"Set-Cookie":               {"session=1"},
+			"X-Custom":                 {"a", "b"},
+			"Upgrade":                  {"h2c"},
+			"Connection":               {"close"},
+			"Sec-Websocket-Accept":     {"forged"},
+			"Sec-Websocket-Protocol":   {"other"},
+			"sec-websocket-extensions": {"permessage-deflate"},
+		},
+	}
+	resp := upgradeResponse(t, u, "", http.Header{"Sec-Websocket-Protocol": {"chat"}})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	for key, want := range map[string][]string{
+		"Set-Cookie":               {"session=1"},
+		"X-Custom":                 {"a", "b"},
+		"Upgrade":                  {"websocket"},
+		"Connection":               {"Upgrade"},
+		"Sec-Websocket-Accept":     {"s3pPLMBiTxaQ9kYGzzhZRbK+xOo="},
+		"Sec-Websocket-Protocol":   {"chat"},
+		"Sec-Websocket-Extensions": nil,
+	} {
+		if got := resp.Header.Values(key); !slices.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestUpgradeCompression(t *testing.T) {
+	offer := http.Header{"Sec-Websocket-Extensions": {"permessage-deflate"}}
+	for _, tt := range []struct {
+		name string
+		u    *Upgrader
+		want bool
+	}{
+		{"default", defaultUpgrader, false},
+		{"zero", &Upgrader{}, false},
+		{"enabled", &Upgrader{EnableCompression: true}, true},
+	} {
+		resp := upgradeResponse(t, tt.u, "", offer)
+		if got := resp.Header.Get("Sec-WebSocket-Extensions") != ""; got != tt.want {
+			t.Errorf("%s: negotiated compression %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpgraderBufferSizes(t *testing.T) {
+	sizes := make(chan [2]int, 2)
+	for _, u := range []*Upgrader{{}, {ReadBufferSize: 1024, WriteBufferSize: 256}} {
+		url := newTestServer(t, u, func(c *Connection) {
+			sizes <- [2]int{c.br.Size(), c.writeBufferSize}
+			c.Close()
+		})
+		dialTest(t, url, nil)
+	}
+	for _, want := range [][2]int{{defaultBufferSize, defaultBufferSize}, {1024, 256}} {
+		if got := <-sizes; got != want {
+			t.Errorf("got read and write buffer sizes %v, want %v", got, want)
+		}
+	}
+}
+
+// TestHandshakeTimeout checks that the handshake timeout no longer applies
+// once the connection is upgraded.
+func TestHandshakeTimeout(t *testing.T) {
+	readErr := make(chan error, 1)
+	url := newTestServer(t, &Upgrader{HandshakeTimeout: 50 * time.Millisecond}, func(c *Connection) {
+		time.Sleep(100 * time.Millisecond)
+		_, _, err := c.Read()
+		readErr <- err
+		c.Close()
+	})
+	c := dialTest(t, url, nil)
+	c.Write(OpText, []byte("hello"))
+	if err := <-readErr; err != nil {
+		t.Errorf("read after the handshake timeout: %v", err)
+	}
+}
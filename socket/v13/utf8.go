@@ -0,0 +1,105 @@
+package v13
+
+import (
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// utf8Validator checks text that arrives in pieces. It rejects the text as
+// soon as the bytes seen so far can't be the start of valid UTF-8, and keeps
+// a rune that is split between pieces until the rest of it arrives.
+type utf8Validator struct {
+	partial [utf8.UTFMax]byte
+	n       int
+}
+
+// write reports whether p validly continues the text seen so far.
+func (v *utf8Validator) write(p []byte) bool {
+	if v.n > 0 {
+		m := copy(v.partial[v.n:], p)
+		b := v.partial[:v.n+m]
+		if !utf8.FullRune(b) {
+			v.n += m
+			return true
+		}
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 {
+			return false
+		}
+		p = p[size-v.n:]
+		v.n = 0
+	}
+
+	// FullRune treats invalid bytes as complete, so an incomplete rune at
+	// the end is always the valid start of one.
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:end]) {
+		return false
+	}
+	v.n = copy(v.partial[:], p[end:])
+	return true
+}
+
+// complete reports whether the text doesn't stop in the middle of a rune.
+func (v *utf8Validator) complete() bool {
+	return v.n == 0
+}
+
+// textReader fails the connection with CloseInvalidFramePayload as soon as a
+// text message turns out not to be valid UTF-8 (RFC 6455 8.1).
+type textReader struct {
+	c *Connection
+	r io.Reader
+	v utf8Validator
+}
+
+func (r *textReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if !r.v.write(p[:n]) || (err == io.EOF && !r.v.complete()) {
+		return 0, r.c.fail(CloseInvalidFramePayload, "Text message is not valid UTF-8")
+	}
+	return n, err
+}
+
+// textWriter rejects writes that would make a text message invalid UTF-8.
+// Once part of the message is out, it can't be finished validly, so closing
+// the writer after a rejected write or in the middle of a rune fails the
+// connection.
+type textWriter struct {
+	c   *Connection
+	w   io.WriteCloser
+	v   utf8Validator
+	err error
+}
+
+func (w *textWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.v.write(p) {
+		w.err = fmt.Errorf("conn: Message is not valid UTF-8")
+		return 0, w.err
+	}
+	return w.w.Write(p)
+}
+
+func (w *textWriter) Close() error {
+	if w.err == nil && !w.v.complete() {
+		w.err = fmt.Errorf("conn: Message is not valid UTF-8")
+	}
+	if w.err != nil {
+		w.c.failWrites(w.err)
+		w.w.Close()
+		return w.err
+	}
+	return w.w.Close()
+}